@@ -0,0 +1,65 @@
+package clickhelper
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// BotClassifier tells the visits of the bots, crawlers and link previewers from the
+// visits of humans, by the patterns of their user agents and the method of the request
+type BotClassifier struct {
+	patterns []*regexp.Regexp
+}
+
+// LoadBotClassifier reads the patterns of the user agents of the bots from the file at
+// path: one regular expression per line, matched case-insensitively anywhere in the
+// user agent. The empty lines and the lines starting with # are ignored. Only the
+// HEAD requests are classified as bots if path is empty
+func LoadBotClassifier(path string) (*BotClassifier, error) {
+	if path == "" {
+		return &BotClassifier{}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBotClassifier(f)
+}
+
+func readBotClassifier(reader io.Reader) (*BotClassifier, error) {
+	c := &BotClassifier{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := regexp.Compile("(?i)" + line)
+		if err != nil {
+			return nil, errors.New("invalid bot pattern " + line + ": " + err.Error())
+		}
+		c.patterns = append(c.patterns, pattern)
+	}
+	return c, scanner.Err()
+}
+
+// IsBot returns true if the request comes from a bot: a HEAD request, sent by the
+// link previewers to check the target, or a user agent matching a pattern
+func (c *BotClassifier) IsBot(r *http.Request) bool {
+	if r.Method == "HEAD" {
+		return true
+	}
+	ua := r.UserAgent()
+	for _, pattern := range c.patterns {
+		if pattern.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
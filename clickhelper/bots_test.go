@@ -0,0 +1,52 @@
+package clickhelper
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+var botUserAgents = map[string]bool{
+	"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": true,
+	"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)":               true,
+	"Twitterbot/1.0": true,
+	"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)": true,
+	"WhatsApp/2.23.20.0": true,
+	"curl/8.4.0":         true,
+	"":                   true,
+	"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                false,
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148": false,
+}
+
+func TestBotClassifier(t *testing.T) {
+	// the patterns shipped with the service
+	f, err := os.Open("../bots.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	classifier, err := readBotClassifier(f)
+	if err != nil {
+		t.Fatal("Could not read the patterns:", err)
+	}
+
+	for ua, expected := range botUserAgents {
+		req, _ := http.NewRequest("GET", "/abc123", nil)
+		req.Header.Set("User-Agent", ua)
+		if bot := classifier.IsBot(req); bot != expected {
+			t.Error("Wrong classification of", ua, "got", bot)
+		}
+	}
+
+	// the HEAD requests are sent by the link previewers
+	req, _ := http.NewRequest("HEAD", "/abc123", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	if !(&BotClassifier{}).IsBot(req) {
+		t.Error("HEAD request not classified as bot")
+	}
+
+	if _, err := readBotClassifier(strings.NewReader("bot\n(unclosed\n")); err == nil {
+		t.Error("Invalid pattern accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package clickhelper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Click describes a visit of a short url, as extracted from the request
+type Click struct {
+	IP          net.IP // the address of the client, nil if unknown
+	UserAgent   string // the raw User-Agent header
+	Referrer    string // the host of the referring page, "direct" if none
+	RawReferrer string // the raw Referer header
+	Browser     string
+	OS          string
+	Device      string
+	Country     string // the country code of the client, "unknown" if not resolved
+	Bot         bool   // sent by a bot, a crawler or a link previewer
+}
+
+// Analyzer extracts the clicks from the redirect requests
+type Analyzer struct {
+	geoIP             *GeoIP // nil if the countries are not resolved
+	bots              *BotClassifier
+	trustForwardedFor bool
+}
+
+// NewAnalyzer creates an analyzer resolving the countries with the GeoIP database
+// file, if set, and detecting the bots with the patterns of the bot patterns file.
+// If trustForwardedFor is set, the address of the client is read from the
+// X-Forwarded-For header set by a load balancer
+func NewAnalyzer(geoIPFile string, botPatternsFile string, trustForwardedFor bool) (*Analyzer, error) {
+	bots, err := LoadBotClassifier(botPatternsFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &Analyzer{bots: bots, trustForwardedFor: trustForwardedFor}
+	if geoIPFile != "" {
+		geoIP, err := LoadGeoIP(geoIPFile)
+		if err != nil {
+			return nil, err
+		}
+		a.geoIP = geoIP
+	}
+	return a, nil
+}
+
+// Analyze returns the click of a redirect request
+func (a *Analyzer) Analyze(r *http.Request) Click {
+	ua := ParseUserAgent(r.UserAgent())
+	click := Click{
+		IP:          ClientIP(r, a.trustForwardedFor),
+		UserAgent:   r.UserAgent(),
+		Referrer:    ReferrerHost(r.Referer()),
+		RawReferrer: r.Referer(),
+		Browser:     ua.Browser,
+		OS:          ua.OS,
+		Device:      ua.Device,
+		Country:     "unknown",
+		Bot:         a.bots != nil && a.bots.IsBot(r),
+	}
+	if a.geoIP != nil && click.IP != nil {
+		if country := a.geoIP.Country(click.IP); country != "" {
+			click.Country = country
+		}
+	}
+	return click
+}
+
+// ClientIP returns the address of the client: the last address of X-Forwarded-For, appended
+// by the load balancer, if trusted, or the remote address of the connection. nil is
+// returned if the address can not be parsed
+func ClientIP(r *http.Request, trustForwardedFor bool) net.IP {
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustForwardedFor && forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// Fingerprint identifies the visitor of the click by a hash of its address and user
+// agent, so that the address is not stored
+func (c Click) Fingerprint() string {
+	sum := sha256.Sum256([]byte(c.IP.String() + "\n" + c.UserAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReferrerHost returns the host of the referring page in lower case, "direct" if
+// there is none or "unknown" if it can not be parsed
+func ReferrerHost(referer string) string {
+	if referer == "" {
+		return "direct"
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,67 @@
+package clickhelper
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var referrers = map[string]string{
+	"":                                    "direct",
+	"https://www.Google.com/search?q=abc": "www.google.com",
+	"http://t.co:8080/abc":                "t.co",
+	"android-app://com.slack":             "com.slack",
+	"not a url":                           "unknown",
+}
+
+func TestReferrerHost(t *testing.T) {
+	for referer, expected := range referrers {
+		if host := ReferrerHost(referer); host != expected {
+			t.Error("Wrong referrer host for", referer, "got", host, "expected", expected)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	geoIP, _ := readGeoIP(strings.NewReader(testGeoIPDatabase))
+	req, _ := http.NewRequest("GET", "/abc123", nil)
+	req.RemoteAddr = "8.8.8.8:41000"
+	req.Header.Set("Referer", "https://news.ycombinator.com/item?id=1")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	req.Header.Set("X-Forwarded-For", "1.0.0.1")
+
+	click := (&Analyzer{geoIP: geoIP}).Analyze(req)
+	if click.IP.String() != "8.8.8.8" || click.Country != "US" || click.Referrer != "news.ycombinator.com" ||
+		click.Browser != "Firefox" || click.OS != "Linux" || click.Device != "desktop" {
+		t.Error("Wrong click: got", click)
+	}
+
+	// the address of the load balancer is replaced by the one of the client
+	click = (&Analyzer{geoIP: geoIP, trustForwardedFor: true}).Analyze(req)
+	if click.IP.String() != "1.0.0.1" || click.Country != "AU" {
+		t.Error("Wrong client of a forwarded request: got", click.IP, click.Country)
+	}
+
+	// the fingerprint depends on the address and user agent only
+	other, _ := http.NewRequest("GET", "/def456", nil)
+	other.RemoteAddr = "1.0.0.1:52000"
+	other.Header.Set("User-Agent", req.UserAgent())
+	if len(click.Fingerprint()) != 64 || click.Fingerprint() != (&Analyzer{}).Analyze(other).Fingerprint() {
+		t.Error("Wrong fingerprint: got", click.Fingerprint())
+	}
+	other.Header.Set("User-Agent", "curl/8.4.0")
+	if click.Fingerprint() == (&Analyzer{}).Analyze(other).Fingerprint() {
+		t.Error("Same fingerprint for another user agent")
+	}
+
+	// no GeoIP database
+	click = (&Analyzer{}).Analyze(req)
+	if click.Country != "unknown" || click.Bot {
+		t.Error("Wrong click without database: got", click)
+	}
+
+	req.Method = "HEAD"
+	if click = (&Analyzer{bots: &BotClassifier{}}).Analyze(req); !click.Bot {
+		t.Error("HEAD request not classified as bot")
+	}
+}
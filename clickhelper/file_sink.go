@@ -0,0 +1,100 @@
+package clickhelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+// FileWriter writes the events as JSON lines in a file, rotated when it reaches its
+// maximum size: the file is renamed with the suffix .1, the previous .1 to .2 and
+// so on, the oldest files beyond the backups are removed
+type FileWriter struct {
+	path    string
+	maxSize int64 // in bytes, the file is not rotated if 0
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// NewFileWriter opens the file to append the events to
+func NewFileWriter(path string, maxSize int64, backups int) (*FileWriter, error) {
+	w := &FileWriter{path: path, maxSize: maxSize, backups: backups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *FileWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// WriteEvents appends the events to the file, one JSON object per line. The file is
+// rotated first if the events would not fit in it
+func (w *FileWriter) WriteEvents(events []Event) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return permanentError{err}
+		}
+	}
+	if w.file == nil {
+		// the previous rotation failed
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(buf.Len()) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(buf.Bytes())
+	w.size += int64(n)
+	return err
+}
+
+// rotate renames the file and its backups and opens a new file
+func (w *FileWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	for i := w.backups - 1; i >= 1; i-- {
+		err := os.Rename(w.path+"."+strconv.Itoa(i), w.path+"."+strconv.Itoa(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if w.backups > 0 {
+		err = os.Rename(w.path, w.path+".1")
+	} else {
+		err = os.Remove(w.path)
+	}
+	if err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Close closes the file
+func (w *FileWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
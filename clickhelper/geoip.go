@@ -0,0 +1,91 @@
+package clickhelper
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIP resolves the country of an IP address from a local database, without any
+// external service. The database is a CSV file of IP ranges, one range per line:
+//
+//	start_ip,end_ip,country_code
+//
+// eg: "1.0.0.0,1.0.0.255,AU". IPv4 and IPv6 ranges can be mixed, as in the free
+// "IP to Country Lite" database of db-ip.com. The lines starting with # are ignored
+type GeoIP struct {
+	ranges []geoRange // sorted by start
+}
+
+// a range of addresses of a country, the addresses are in their 16 bytes form
+type geoRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+// LoadGeoIP reads the database file at path
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readGeoIP(f)
+}
+
+func readGeoIP(reader io.Reader) (*GeoIP, error) {
+	r := csv.NewReader(reader)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1 // the extra columns of some databases are ignored
+
+	var ranges []geoRange
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, errors.New("invalid GeoIP range: " + strings.Join(record, ","))
+		}
+		start := net.ParseIP(strings.TrimSpace(record[0]))
+		end := net.ParseIP(strings.TrimSpace(record[1]))
+		if start == nil || end == nil {
+			// header line of some databases
+			if len(ranges) == 0 {
+				continue
+			}
+			return nil, errors.New("invalid GeoIP range: " + strings.Join(record, ","))
+		}
+		ranges = append(ranges, geoRange{
+			start:   start.To16(),
+			end:     end.To16(),
+			country: strings.ToUpper(strings.TrimSpace(record[2])),
+		})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start, ranges[j].start) < 0 })
+	return &GeoIP{ranges: ranges}, nil
+}
+
+// Country returns the country code of the IP address, or an empty string if it
+// is not in the database
+func (g *GeoIP) Country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	// the last range starting before the address
+	i := sort.Search(len(g.ranges), func(i int) bool { return bytes.Compare(g.ranges[i].start, ip) > 0 }) - 1
+	if i < 0 || bytes.Compare(ip, g.ranges[i].end) > 0 {
+		return ""
+	}
+	return g.ranges[i].country
+}
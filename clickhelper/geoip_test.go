@@ -0,0 +1,42 @@
+package clickhelper
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testGeoIPDatabase = `# test database
+start_ip,end_ip,country
+1.0.0.0,1.0.0.255,AU
+8.8.8.0,8.8.8.255,us
+2.16.0.0,2.16.255.255,FR
+2001:4860::,2001:4860:ffff:ffff:ffff:ffff:ffff:ffff,US
+`
+
+var geoIPCountries = map[string]string{
+	"1.0.0.1":              "AU",
+	"8.8.8.8":              "US",
+	"2.16.12.3":            "FR",
+	"2.17.0.0":             "",
+	"0.0.0.1":              "",
+	"255.255.255.255":      "",
+	"2001:4860:4860::8888": "US",
+	"2001:db8::1":          "",
+}
+
+func TestGeoIP(t *testing.T) {
+	geoIP, err := readGeoIP(strings.NewReader(testGeoIPDatabase))
+	if err != nil {
+		t.Fatal("Could not read the database:", err)
+	}
+	for ip, expected := range geoIPCountries {
+		if country := geoIP.Country(net.ParseIP(ip)); country != expected {
+			t.Error("Wrong country for", ip, "got", country, "expected", expected)
+		}
+	}
+
+	if _, err := readGeoIP(strings.NewReader("1.0.0.0,1.0.0.255,AU\n1.0.1.0,AU\n")); err == nil {
+		t.Error("Invalid database read")
+	}
+}
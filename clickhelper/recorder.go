@@ -0,0 +1,210 @@
+package clickhelper
+
+import (
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the policies when the buffer of the recorder is full
+const (
+	DropNewest = "drop-newest" // the new click is dropped
+	DropOldest = "drop-oldest" // the oldest queued click is dropped for the new one
+	Block      = "block"       // the redirection waits for a free place
+)
+
+// Recorder records the clicks in the store off the path of the redirections: the
+// clicks are queued in a bounded buffer and recorded in batches by workers
+type Recorder struct {
+	dropped       int64 // accessed atomically, first for the alignment on 32-bit platforms
+	linkStore     store.LinkStore
+	retention     map[store.Granularity]time.Duration
+	clicks        chan store.Click // nil if the clicks are recorded synchronously
+	batchSize     int
+	flushInterval time.Duration
+	overflow      string
+	sinks         []*Sink
+	ipKey         string // the key of the hashes of the addresses in the exported events
+
+	// closed is guarded by the mutex so that no click is queued after the buffer is closed
+	mutex   sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// NewRecorder creates a recorder with the buffer, workers and overflow policy of the
+// configuration and starts its workers. Without buffer, the clicks are recorded by
+// Record. The clicks are also exported to the sinks, if any. Close must be called
+// to record the queued clicks, stop the workers and close the sinks
+func NewRecorder(linkStore store.LinkStore, conf *confighelper.Config, sinks ...*Sink) *Recorder {
+	r := &Recorder{
+		linkStore: linkStore,
+		retention: map[store.Granularity]time.Duration{
+			store.Hourly: time.Duration(conf.HourlyStatsRetentionDays) * 24 * time.Hour,
+			store.Daily:  time.Duration(conf.DailyStatsRetentionDays) * 24 * time.Hour,
+		},
+		batchSize:     conf.ClickBatchSize,
+		flushInterval: time.Duration(conf.ClickFlushIntervalMs) * time.Millisecond,
+		overflow:      conf.ClickOverflowPolicy,
+		sinks:         sinks,
+		ipKey:         conf.ClickExportIPKey,
+	}
+	if r.batchSize < 1 {
+		r.batchSize = 1
+	}
+	if r.flushInterval <= 0 {
+		r.flushInterval = time.Second
+	}
+	if conf.ClickBufferSize > 0 {
+		r.clicks = make(chan store.Click, conf.ClickBufferSize)
+		workers := conf.ClickWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		r.workers.Add(workers)
+		for i := 0; i < workers; i++ {
+			go r.work()
+		}
+	}
+	return r
+}
+
+// Record queues the click of the token of the namespace, or records it if the recorder
+// has no buffer, and sends its event with the domain of the short url to the sinks. It
+// returns false if the click was dropped by the recorder
+func (r *Recorder) Record(domain string, namespace string, token string, click Click) bool {
+	now := time.Now()
+	if len(r.sinks) > 0 {
+		// the same event for all the sinks, the address is only hashed once
+		exported := NewEvent(domain, token, now, click, r.ipKey)
+		for _, sink := range r.sinks {
+			sink.Send(exported)
+		}
+	}
+
+	token = store.NamespacedToken(namespace, token)
+	event := store.Click{Token: token, Time: now, Bot: click.Bot}
+	if !click.Bot {
+		// the bots are only counted
+		event.Breakdowns = map[store.Dimension]string{
+			store.Referrer: click.Referrer,
+			store.Browser:  click.Browser,
+			store.OS:       click.OS,
+			store.Device:   click.Device,
+			store.Country:  click.Country,
+		}
+		event.Fingerprint = click.Fingerprint()
+	}
+	if r.clicks == nil {
+		r.flush([]store.Click{event})
+		return true
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.closed {
+		log.WithField("token", token).Warn("click recorded after the recorder was closed, click dropped")
+		return false
+	}
+	switch r.overflow {
+	case Block:
+		r.clicks <- event
+		return true
+	case DropOldest:
+		for {
+			select {
+			case r.clicks <- event:
+				return true
+			default:
+				// make room, unless a worker just did
+				select {
+				case oldest := <-r.clicks:
+					r.drop(oldest)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case r.clicks <- event:
+			return true
+		default:
+			r.drop(event)
+			return false
+		}
+	}
+}
+
+// Dropped returns the number of clicks dropped as the buffer was full
+func (r *Recorder) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// Close stops queuing the clicks, waits for the workers to record the queued ones
+// and closes the sinks
+func (r *Recorder) Close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	if r.clicks != nil {
+		close(r.clicks)
+	}
+	r.mutex.Unlock()
+
+	r.workers.Wait()
+	if dropped := r.Dropped(); dropped > 0 {
+		log.WithField("dropped", dropped).Warn("clicks dropped as the click buffer was full")
+	}
+	for _, sink := range r.sinks {
+		if err := sink.Close(); err != nil {
+			log.WithError(err).Error("error while closing the click sink")
+		}
+	}
+}
+
+// work records the queued clicks by batches, a batch is recorded when it is full or
+// when the flush interval elapsed. The last batch is recorded when the buffer is closed
+func (r *Recorder) work() {
+	defer r.workers.Done()
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]store.Click, 0, r.batchSize)
+	for {
+		select {
+		case click, ok := <-r.clicks:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, click)
+			if len(batch) < r.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		r.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush records a batch of clicks, the errors are only logged: the clicks are lost
+func (r *Recorder) flush(batch []store.Click) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := r.linkStore.RecordClicks(batch, r.retention); err != nil {
+		log.WithError(err).WithField("clicks", len(batch)).Error("error while recording the clicks")
+	}
+}
+
+func (r *Recorder) drop(click store.Click) {
+	atomic.AddInt64(&r.dropped, 1)
+	log.WithField("token", click.Token).Debug("click buffer full, click dropped")
+}
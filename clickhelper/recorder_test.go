@@ -0,0 +1,148 @@
+package clickhelper
+
+import (
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingStore blocks the recording of the clicks until it is released
+type blockingStore struct {
+	*store.MemoryStore
+	started chan struct{} // receives a value when a batch starts to be recorded
+	release chan struct{}
+}
+
+func (s *blockingStore) RecordClicks(clicks []store.Click, retention map[store.Granularity]time.Duration) error {
+	s.started <- struct{}{}
+	<-s.release
+	return s.MemoryStore.RecordClicks(clicks, retention)
+}
+
+func newRecorderTestStore() *store.MemoryStore {
+	s := store.NewMemoryStore()
+	s.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	return s
+}
+
+func TestRecorderSynchronous(t *testing.T) {
+	s := newRecorderTestStore()
+	defer s.Close()
+	recorder := NewRecorder(s, &confighelper.Config{})
+	defer recorder.Close()
+
+	recorder.Record("myhost.com", "", "abc123", Click{Browser: "Firefox"})
+	recorder.Record("myhost.com", "", "abc123", Click{Bot: true})
+	link, _ := s.GetLink("abc123")
+	if link.Count != 1 || link.BotCount != 1 {
+		t.Error("Clicks not recorded: got", link.Count, link.BotCount)
+	}
+}
+
+func TestRecorderBatches(t *testing.T) {
+	s := newRecorderTestStore()
+	defer s.Close()
+	recorder := NewRecorder(s, &confighelper.Config{ClickBufferSize: 100, ClickWorkers: 2,
+		ClickBatchSize: 10, ClickFlushIntervalMs: 10, ClickOverflowPolicy: DropNewest})
+
+	for i := 0; i < 25; i++ {
+		if !recorder.Record("myhost.com", "", "abc123", Click{Browser: "Firefox"}) {
+			t.Error("Click dropped")
+		}
+	}
+	// the incomplete batches are recorded after the flush interval
+	time.Sleep(100 * time.Millisecond)
+	if link, _ := s.GetLink("abc123"); link.Count != 25 {
+		t.Error("Wrong count after the flush interval: got", link.Count)
+	}
+
+	// the queued clicks are recorded on close
+	for i := 0; i < 5; i++ {
+		recorder.Record("myhost.com", "", "abc123", Click{Browser: "Firefox"})
+	}
+	recorder.Close()
+	if link, _ := s.GetLink("abc123"); link.Count != 30 {
+		t.Error("Queued clicks not recorded on close: got", link.Count)
+	}
+	if recorder.Record("myhost.com", "", "abc123", Click{}) {
+		t.Error("Click queued after close")
+	}
+}
+
+func TestRecorderOverflow(t *testing.T) {
+	for _, policy := range []string{DropNewest, DropOldest} {
+		s := &blockingStore{newRecorderTestStore(), make(chan struct{}), make(chan struct{})}
+		recorder := NewRecorder(s, &confighelper.Config{ClickBufferSize: 2, ClickWorkers: 1,
+			ClickBatchSize: 1, ClickFlushIntervalMs: 1000, ClickOverflowPolicy: policy})
+
+		// the worker is blocked with the first click, the buffer holds the next two
+		recorder.Record("myhost.com", "", "abc123", Click{Browser: "first"})
+		<-s.started
+		recorder.Record("myhost.com", "", "abc123", Click{Browser: "second"})
+		recorder.Record("myhost.com", "", "abc123", Click{Browser: "third"})
+		recorded := recorder.Record("myhost.com", "", "abc123", Click{Browser: "fourth"})
+		if recorded != (policy == DropOldest) || recorder.Dropped() != 1 {
+			t.Error("Wrong overflow with", policy, "got", recorded, recorder.Dropped())
+		}
+
+		go func() {
+			for range s.started {
+			}
+		}()
+		close(s.release)
+		recorder.Close()
+		close(s.started)
+
+		entries, _ := s.GetBreakdown("abc123", store.Browser, 10)
+		values := map[string]bool{}
+		for _, entry := range entries {
+			values[entry.Value] = true
+		}
+		expected := map[string]bool{"first": true, "second": policy == DropNewest, "third": true, "fourth": policy == DropOldest}
+		for value, kept := range expected {
+			if values[value] != kept {
+				t.Error("Wrong clicks recorded with", policy, "got", entries)
+				break
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestRecorderSinks(t *testing.T) {
+	s := newRecorderTestStore()
+	defer s.Close()
+	writer := &memoryWriter{}
+	recorder := NewRecorder(s, &confighelper.Config{ClickExportIPKey: "secret"}, NewSink("memory", writer, testSinkConf))
+
+	recorder.Record("myhost.com", "", "abc123", Click{IP: net.ParseIP("1.2.3.4"), UserAgent: "curl/8.4.0", Bot: true})
+	recorder.Record("hr.example.com", "hr", "abc123", Click{Browser: "Firefox"})
+	recorder.Close()
+
+	// the events of the bots are exported too
+	if len(writer.events) != 2 || !writer.events[0].Bot || writer.events[0].IPHash == "" || !writer.closed {
+		t.Error("Wrong events exported: got", writer.events, writer.closed)
+	}
+	// the tokens are exported without the namespace of their domain
+	if len(writer.events) == 2 && (writer.events[1].Host != "hr.example.com" || writer.events[1].Token != "abc123") {
+		t.Error("Wrong token exported: got", writer.events[1])
+	}
+}
+
+// memoryWriter keeps the events written by a sink
+type memoryWriter struct {
+	events []Event
+	closed bool
+}
+
+func (w *memoryWriter) WriteEvents(events []Event) error {
+	w.events = append(w.events, events...)
+	return nil
+}
+
+func (w *memoryWriter) Close() error {
+	w.closed = true
+	return nil
+}
@@ -0,0 +1,235 @@
+package clickhelper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the wait before the first retry of a batch, doubled on each retry
+const sinkRetryBackoff = 500 * time.Millisecond
+
+// Event is a raw click exported to the sinks
+type Event struct {
+	Host      string    `json:"host"`  // the domain of the short url
+	Token     string    `json:"token"` // the token of the short url, without the namespace of the domain
+	Timestamp time.Time `json:"timestamp"`
+	Referrer  string    `json:"referrer"`  // the raw Referer header, empty if none
+	UserAgent string    `json:"userAgent"` // the raw User-Agent header
+	IPHash    string    `json:"ipHash"`    // the keyed hash of the address of the client, empty if unknown
+	Bot       bool      `json:"bot"`
+}
+
+// EventWriter writes the batches of events of a sink to its destination
+type EventWriter interface {
+	WriteEvents(events []Event) error
+	Close() error
+}
+
+// permanentError is returned by the writers for the batches which would fail again
+// if retried, eg: rejected by the webhook
+type permanentError struct {
+	error
+}
+
+// Sink exports the click events off the path of the redirections: the events are
+// queued in a bounded buffer and written in batches by a worker, the failed batches
+// are retried with an exponential backoff until the deadline of Close
+type Sink struct {
+	dropped       int64 // accessed atomically, first for the alignment on 32-bit platforms
+	name          string
+	writer        EventWriter
+	events        chan Event
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+	backoff       time.Duration
+	timeout       time.Duration // the time Close waits for the queued events, no limit if 0
+
+	// closed is guarded by the mutex so that no event is queued after the buffer is closed
+	mutex  sync.RWMutex
+	closed bool
+	stop   chan struct{} // closed at the deadline of Close, the failed batches are then dropped
+	done   chan struct{}
+}
+
+// NewSinks creates the sinks enabled in the configuration: the JSON lines file and
+// the webhook. Close must be called on each sink to write the queued events. An error is
+// returned if a sink is enabled without the key of the hashes of the addresses
+func NewSinks(conf *confighelper.Config) ([]*Sink, error) {
+	// without a secret key, the addresses could be recovered from their hashes by hashing
+	// all the addresses
+	if (conf.ClickExportFile != "" || conf.ClickWebhookUrl != "") && conf.ClickExportIPKey == "" {
+		return nil, errors.New("the clickExportIPKey must be set to export the clicks")
+	}
+	var sinks []*Sink
+	if conf.ClickExportFile != "" {
+		writer, err := NewFileWriter(conf.ClickExportFile, int64(conf.ClickExportFileMaxMB)<<20, conf.ClickExportFileBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, NewSink("file", writer, conf))
+	}
+	if conf.ClickWebhookUrl != "" {
+		writer := NewWebhookWriter(conf.ClickWebhookUrl, time.Duration(conf.ClickWebhookTimeoutMs)*time.Millisecond)
+		sinks = append(sinks, NewSink("webhook", writer, conf))
+	}
+	return sinks, nil
+}
+
+// NewSink creates a sink writing the events with the writer, with the buffer,
+// batches and retries of the configuration, and starts its worker. The queued events
+// are written on Close until the shutdown timeout of the configuration
+func NewSink(name string, writer EventWriter, conf *confighelper.Config) *Sink {
+	s := &Sink{
+		name:          name,
+		writer:        writer,
+		events:        make(chan Event, conf.ClickExportBufferSize),
+		batchSize:     conf.ClickExportBatchSize,
+		flushInterval: time.Duration(conf.ClickExportFlushIntervalMs) * time.Millisecond,
+		retries:       conf.ClickExportRetries,
+		backoff:       sinkRetryBackoff,
+		timeout:       time.Duration(conf.ShutdownTimeoutMs) * time.Millisecond,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if s.batchSize < 1 {
+		s.batchSize = 1
+	}
+	if s.flushInterval <= 0 {
+		s.flushInterval = time.Second
+	}
+	go s.work()
+	return s
+}
+
+// NewEvent returns the event of the click of the token of the domain. The address of
+// the client is hashed with the key so that it can not be recovered from the exports
+func NewEvent(domain string, token string, t time.Time, click Click, key string) Event {
+	event := Event{
+		Host:      domain,
+		Token:     token,
+		Timestamp: t.UTC(),
+		Referrer:  click.RawReferrer,
+		UserAgent: click.UserAgent,
+		Bot:       click.Bot,
+	}
+	if click.IP != nil {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(click.IP.String()))
+		event.IPHash = hex.EncodeToString(mac.Sum(nil))
+	}
+	return event
+}
+
+// Send queues the event, it is dropped if the buffer is full. It returns false if
+// the event was dropped
+func (s *Sink) Send(event Event) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.events <- event:
+		return true
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		log.WithField("sink", s.name).Debug("click export buffer full, event dropped")
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped as the buffer was full or the
+// writes failed
+func (s *Sink) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close stops queuing the events, waits for the worker to write the queued ones and
+// closes the writer. The batches still failing at the deadline are not retried
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.events)
+	s.mutex.Unlock()
+
+	if s.timeout > 0 {
+		deadline := time.AfterFunc(s.timeout, func() { close(s.stop) })
+		defer deadline.Stop()
+	}
+	<-s.done
+	if dropped := s.Dropped(); dropped > 0 {
+		log.WithFields(log.Fields{"sink": s.name, "dropped": dropped}).Warn("click events not exported")
+	}
+	return s.writer.Close()
+}
+
+// work writes the queued events by batches, a batch is written when it is full or
+// when the flush interval elapsed. The last batch is written when the buffer is closed
+func (s *Sink) work() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, s.batchSize)
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				s.write(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		s.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// write writes a batch, retrying on failure. The batch is dropped once the retries
+// are exhausted, if the failure is permanent or at the deadline of Close
+func (s *Sink) write(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := s.writer.WriteEvents(batch)
+		if err == nil {
+			return
+		}
+		var permanent permanentError
+		if attempt >= s.retries || errors.As(err, &permanent) {
+			atomic.AddInt64(&s.dropped, int64(len(batch)))
+			log.WithError(err).WithFields(log.Fields{"sink": s.name, "events": len(batch)}).
+				Error("could not export the click events, events dropped")
+			return
+		}
+		log.WithError(err).WithFields(log.Fields{"sink": s.name, "attempt": attempt + 1}).
+			Warn("could not export the click events, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			atomic.AddInt64(&s.dropped, int64(len(batch)))
+			log.WithFields(log.Fields{"sink": s.name, "events": len(batch)}).
+				Error("could not export the click events before the shutdown timeout, events dropped")
+			return
+		}
+		backoff *= 2
+	}
+}
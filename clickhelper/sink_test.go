@@ -0,0 +1,183 @@
+package clickhelper
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the configuration of the sinks in the tests: the batches are written on close
+var testSinkConf = &confighelper.Config{
+	ClickExportBufferSize:      100,
+	ClickExportBatchSize:       10,
+	ClickExportFlushIntervalMs: 1000,
+	ClickExportRetries:         2,
+}
+
+func TestNewEvent(t *testing.T) {
+	click := Click{IP: net.ParseIP("1.2.3.4"), UserAgent: "curl/8.4.0", RawReferrer: "https://t.co/x", Bot: true}
+	event := NewEvent("myhost.com", "abc123", time.Unix(1700000000, 0), click, "secret")
+	if event.Host != "myhost.com" || event.Token != "abc123" || event.Referrer != "https://t.co/x" || event.UserAgent != "curl/8.4.0" || !event.Bot {
+		t.Error("Wrong event: got", event)
+	}
+	// the address is hashed with the key
+	if len(event.IPHash) != 64 || event.IPHash == NewEvent("myhost.com", "abc123", time.Now(), click, "other").IPHash {
+		t.Error("Wrong address hash: got", event.IPHash)
+	}
+	if event := NewEvent("myhost.com", "abc123", time.Now(), Click{}, "secret"); event.IPHash != "" {
+		t.Error("Hash of an unknown address: got", event.IPHash)
+	}
+}
+
+func TestNewSinks(t *testing.T) {
+	// no sink without the key of the hashes of the addresses
+	conf := *testSinkConf
+	conf.ClickWebhookUrl = "http://localhost/clicks"
+	if _, err := NewSinks(&conf); err == nil {
+		t.Error("Sink created without the key of the hashes")
+	}
+
+	conf.ClickExportIPKey = "secret"
+	sinks, err := NewSinks(&conf)
+	if err != nil || len(sinks) != 1 {
+		t.Fatal("Could not create the sink:", err)
+	}
+	sinks[0].Close()
+
+	// no key needed without sink
+	if sinks, err := NewSinks(testSinkConf); err != nil || len(sinks) != 0 {
+		t.Error("Wrong sinks without export: got", sinks, err)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shorturls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clicks.jsonl")
+
+	// each batch of events is larger than the maximum size
+	writer, err := NewFileWriter(path, 100, 2)
+	if err != nil {
+		t.Fatal("Could not open the file:", err)
+	}
+	event := Event{Token: "abc123", Timestamp: time.Unix(1700000000, 0).UTC(), UserAgent: "curl/8.4.0"}
+	for i := 0; i < 4; i++ {
+		if err := writer.WriteEvents([]Event{event, event}); err != nil {
+			t.Fatal("Could not write the events:", err)
+		}
+	}
+	writer.Close()
+
+	// the current file and two backups, the oldest batch was removed
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal("Missing file:", err)
+		}
+		lines := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var read Event
+			if err := json.Unmarshal(scanner.Bytes(), &read); err != nil || read != event {
+				t.Error("Wrong line in", name, "got", scanner.Text())
+			}
+			lines++
+		}
+		f.Close()
+		if lines != 2 {
+			t.Error("Wrong number of events in", name, "got", lines)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Too many backups kept")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mutex sync.Mutex
+	var received []Event
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		// the first attempt fails
+		if requests == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		var events []Event
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(400)
+			return
+		}
+		received = append(received, events...)
+	}))
+	defer server.Close()
+
+	sink := NewSink("webhook", NewWebhookWriter(server.URL, time.Second), testSinkConf)
+	sink.backoff = time.Millisecond
+	for i := 0; i < 15; i++ {
+		sink.Send(Event{Token: "abc123"})
+	}
+	sink.Close()
+
+	// a full batch, retried once, and the last batch on close
+	if len(received) != 15 || requests != 3 || sink.Dropped() != 0 {
+		t.Error("Wrong events received: got", len(received), "in", requests, "requests, dropped", sink.Dropped())
+	}
+	if sink.Send(Event{Token: "abc123"}) {
+		t.Error("Event sent after close")
+	}
+}
+
+func TestWebhookSinkRejected(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(400)
+	}))
+	defer server.Close()
+
+	sink := NewSink("webhook", NewWebhookWriter(server.URL, time.Second), testSinkConf)
+	sink.backoff = time.Millisecond
+	sink.Send(Event{Token: "abc123"})
+	sink.Close()
+
+	// the rejected batches are not retried
+	if requests != 1 || sink.Dropped() != 1 {
+		t.Error("Rejected batch retried: got", requests, "requests, dropped", sink.Dropped())
+	}
+}
+
+func TestSinkCloseDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	conf := *testSinkConf
+	conf.ShutdownTimeoutMs = 50
+	sink := NewSink("webhook", NewWebhookWriter(server.URL, time.Second), &conf)
+	// the retry would wait far longer than the shutdown timeout
+	sink.backoff = time.Hour
+	sink.Send(Event{Token: "abc123"})
+
+	start := time.Now()
+	sink.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second || sink.Dropped() != 1 {
+		t.Error("Retry not stopped at the deadline: closed in", elapsed, "dropped", sink.Dropped())
+	}
+}
@@ -0,0 +1,80 @@
+package clickhelper
+
+import (
+	"strings"
+)
+
+// UserAgent holds the classes parsed from a User-Agent header
+type UserAgent struct {
+	Browser string // eg: Chrome, Firefox, Safari
+	OS      string // eg: Windows, macOS, Android
+	Device  string // desktop, mobile, tablet or unknown
+}
+
+// a class and the substrings of the user agents of the class
+type uaPattern struct {
+	name       string
+	substrings []string
+}
+
+// the browsers, the first matching pattern wins: the user agents of most browsers
+// also contain the names of the browsers they derive from (eg: "Chrome" and "Safari"
+// in the user agent of Edge)
+var browserPatterns = []uaPattern{
+	{"Edge", []string{"Edg/", "Edge/", "EdgA/", "EdgiOS/"}},
+	{"Opera", []string{"OPR/", "Opera"}},
+	{"Samsung Internet", []string{"SamsungBrowser/"}},
+	{"Firefox", []string{"Firefox/", "FxiOS/"}},
+	{"Chrome", []string{"Chrome/", "CriOS/", "Chromium/"}},
+	{"Safari", []string{"Safari/"}},
+	{"Internet Explorer", []string{"MSIE ", "Trident/"}},
+}
+
+// the operating systems, the first matching pattern wins
+var osPatterns = []uaPattern{
+	{"Windows", []string{"Windows"}},
+	{"iOS", []string{"iPhone", "iPad", "iPod"}},
+	{"macOS", []string{"Macintosh", "Mac OS X"}},
+	{"Android", []string{"Android"}},
+	{"Chrome OS", []string{"CrOS"}},
+	{"Linux", []string{"Linux"}},
+}
+
+// ParseUserAgent classifies a User-Agent header by browser, operating system and
+// device. The unknown classes are "other", or "unknown" for an empty user agent
+func ParseUserAgent(ua string) UserAgent {
+	if ua == "" {
+		return UserAgent{Browser: "unknown", OS: "unknown", Device: "unknown"}
+	}
+	return UserAgent{
+		Browser: matchPattern(ua, browserPatterns),
+		OS:      matchPattern(ua, osPatterns),
+		Device:  deviceClass(ua),
+	}
+}
+
+// the name of the first pattern matching the user agent, "other" if none matches
+func matchPattern(ua string, patterns []uaPattern) string {
+	for _, pattern := range patterns {
+		for _, substring := range pattern.substrings {
+			if strings.Contains(ua, substring) {
+				return pattern.name
+			}
+		}
+	}
+	return "other"
+}
+
+func deviceClass(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+		(strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile")):
+		// the Android tablets do not have "Mobile" in their user agents
+		return "tablet"
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPod") ||
+		strings.Contains(ua, "Windows Phone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
@@ -0,0 +1,38 @@
+package clickhelper
+
+import (
+	"testing"
+)
+
+var userAgents = map[string]UserAgent{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36": {
+		"Chrome", "Windows", "desktop"},
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91": {
+		"Edge", "Windows", "desktop"},
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15": {
+		"Safari", "macOS", "desktop"},
+	"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0": {
+		"Firefox", "Linux", "desktop"},
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1": {
+		"Safari", "iOS", "mobile"},
+	"Mozilla/5.0 (iPad; CPU OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1": {
+		"Chrome", "iOS", "tablet"},
+	"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36": {
+		"Chrome", "Android", "mobile"},
+	"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Safari/537.36": {
+		"Samsung Internet", "Android", "tablet"},
+	"Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko": {
+		"Internet Explorer", "Windows", "desktop"},
+	"curl/8.4.0": {
+		"other", "other", "desktop"},
+	"": {
+		"unknown", "unknown", "unknown"},
+}
+
+func TestParseUserAgent(t *testing.T) {
+	for ua, expected := range userAgents {
+		if parsed := ParseUserAgent(ua); parsed != expected {
+			t.Error("Wrong classes for", ua, "got", parsed, "expected", expected)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package clickhelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WebhookWriter posts the batches of events to a webhook as a JSON array
+type WebhookWriter struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookWriter creates a writer posting to the url, the requests are cancelled
+// after the timeout
+func NewWebhookWriter(url string, timeout time.Duration) *WebhookWriter {
+	return &WebhookWriter{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// WriteEvents posts the events, the batch is accepted if the webhook answers with a
+// 2xx status code. The batches rejected with a 4xx status code, except 408 and 429,
+// are not retried
+func (w *WebhookWriter) WriteEvents(events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return permanentError{err}
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// read the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = errors.New("webhook answered with status code " + strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 408 && resp.StatusCode != 429 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Close releases the idle connections to the webhook
+func (w *WebhookWriter) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
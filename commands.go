@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/handlers"
+	"github.com/BenoitHanotte/shorturls/store"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// the one-shot commands run instead of the server with: shorturls <command> [args...]
+var commands = map[string]func(conf *confighelper.Config, args []string) error{
+	"migrate-redis-keys": migrateRedisKeys,
+	"api-keys":           manageAPIKeys,
+}
+
+// the usage of the api-keys command
+const apiKeysUsage = "usage: api-keys issue <name> <scope>[,<scope>...] [<tenant>] | api-keys list | api-keys revoke <id>"
+
+// run the command given in the arguments of the program
+func runCommand(conf *confighelper.Config, args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return errors.New("unknown command: " + args[0])
+	}
+	return command(conf, args[1:])
+}
+
+// rename the links stored under their bare token to the keys of the versioned layout
+func migrateRedisKeys(conf *confighelper.Config, args []string) error {
+	redisClient, err := setUpRedis(conf)
+	if err != nil {
+		return err
+	}
+	defer redisClient.Close()
+
+	// the keys can not be renamed from a node to another in a cluster
+	client, ok := redisClient.(*redis.Client)
+	if !ok {
+		return errors.New("the migration of the keys is not supported in cluster mode")
+	}
+
+	migrated, err := store.MigrateRedisKeys(client, conf.RedisKeyPrefix)
+	log.WithField("migrated", migrated).Info("links migrated to the versioned keys")
+	return err
+}
+
+// issue, list or revoke the API keys stored in the storage of the configuration
+func manageAPIKeys(conf *confighelper.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(apiKeysUsage)
+	}
+
+	linkStore, err := setUpStore(conf)
+	if err != nil {
+		return err
+	}
+	defer linkStore.Close()
+
+	switch {
+	case args[0] == "issue" && (len(args) == 3 || len(args) == 4):
+		// the key is only valid for the requests to the domains of its tenant
+		tenantName := confighelper.DefaultTenantName
+		if len(args) == 4 {
+			tenantName = args[3]
+		}
+		tenant, ok := conf.LookupTenant(tenantName)
+		if !ok {
+			return errors.New("unknown tenant: " + tenantName)
+		}
+		// the key is only shown once, only its hash is stored
+		key, apiKey, err := handlers.IssueKey(linkStore, tenant, args[1], strings.Split(args[2], ","))
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"id":     apiKey.ID,
+			"name":   apiKey.Name,
+			"tenant": apiKey.Tenant,
+			"scopes": apiKey.Scopes}).Info("API key issued")
+		fmt.Println(key)
+		return nil
+
+	case args[0] == "list" && len(args) == 1:
+		keys, err := linkStore.ListKeys()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tTENANT\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.Revoked() {
+				revoked = time.Unix(key.RevokedTime, 0).UTC().Format(time.RFC3339)
+			}
+			// the keys issued before the tenants are the ones of the default tenant
+			tenant := key.Tenant
+			if tenant == "" {
+				tenant = confighelper.DefaultTenantName
+			}
+			fmt.Fprintln(w, key.ID+"\t"+key.Name+"\t"+tenant+"\t"+strings.Join(key.Scopes, ",")+"\t"+
+				time.Unix(key.CreationTime, 0).UTC().Format(time.RFC3339)+"\t"+revoked)
+		}
+		return w.Flush()
+
+	case args[0] == "revoke" && len(args) == 2:
+		if err := linkStore.RevokeKey(args[1]); err == store.ErrNotFound {
+			return errors.New("unknown API key: " + args[1])
+		} else if err != nil {
+			return err
+		}
+		log.WithField("id", args[1]).Info("API key revoked")
+		return nil
+
+	default:
+		return errors.New(apiKeysUsage)
+	}
+}
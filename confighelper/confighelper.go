@@ -5,19 +5,64 @@ import (
 	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/spf13/viper"
 	"os"
+	"strings"
 )
 
 type Config struct {
 	TokenLength    			int    			// the length of the value (eg: x8f9Rz for toto.com/x8f9Rz)
 	ReachTimeoutMs 			int    			// the timeout in ms when checking the reachability of an url
 	ExpirationTimeMonths	int				// the number of months before a short url is deleted
+	MaxLinksPerDay			int				// the number of links that can be created per day, 0 for no quota
+	MaxExpirationMonths		int				// the maximum expiration that can be requested, in months
 	Host           			string 			// the host to use (eg: toto.com), default: HOST env variable
+	Domains					[]string		// the other short domains allowed, each one with its own tokens
 	Port           			int    			// the port of the server
 	Proto          			string 			// the protocol
+	RedirectStatus 			int    			// the default status code of the redirections
+	AdminSecret    			string 			// the bearer token required to delete and update links, disabled if empty
+	RequireAPIKey			bool			// only serve the creations and statistics to the requests with an API key, true by default
+	HourlyStatsRetentionDays	int			// the number of days the hourly click statistics are kept
+	DailyStatsRetentionDays		int			// the number of days the daily click statistics are kept
+	GeoIPFile				string			// the CSV database resolving the countries of the clicks, disabled if empty
+	BotPatternsFile			string			// the patterns of the user agents of the bots, one per line
+	TrustForwardedFor		bool			// read the address of the clients from X-Forwarded-For
+	CreateRateLimitPerIP	int				// the create requests per minute by client address, 0 for no limit
+	CreateRateLimitPerKey	int				// the create requests per minute by API key, 0 for no limit
+	AdminRateLimitPerIP		int				// the admin requests per minute by client address, 0 for no limit
+	AdminRateLimitPerKey	int				// the admin requests per minute by API key, 0 for no limit
+	RateLimitShared			bool			// count the requests in the storage so that the limits hold across the servers
+	ClickBufferSize			int				// the clicks waiting to be recorded, 0 to record them during the redirections
+	ClickWorkers			int				// the number of workers recording the clicks
+	ClickBatchSize			int				// the maximum number of clicks recorded at once by a worker
+	ClickFlushIntervalMs	int				// the maximum time in ms a click waits for its batch to be full
+	ClickOverflowPolicy		string			// when the buffer is full: "drop-newest" (default), "drop-oldest" or "block"
+	ClickExportFile			string			// the JSON lines file the click events are exported to, disabled if empty
+	ClickExportFileMaxMB	int				// the size in MB at which the export file is rotated
+	ClickExportFileBackups	int				// the number of rotated export files kept
+	ClickWebhookUrl			string			// the webhook the click events are posted to, disabled if empty
+	ClickWebhookTimeoutMs	int				// the timeout in ms of the requests to the webhook
+	ClickExportBufferSize	int				// the events waiting to be exported, by sink
+	ClickExportBatchSize	int				// the maximum number of events exported at once
+	ClickExportFlushIntervalMs	int			// the maximum time in ms an event waits for its batch to be full
+	ClickExportRetries		int				// the number of retries of a batch which could not be exported
+	ClickExportIPKey		string			// the key of the hashes of the addresses of the clients in the events
+	ReadyTimeoutMs			int				// the timeout in ms of the storage ping of the readiness checks
+	ShutdownDelayMs			int				// the time in ms the readiness checks fail before the server stops
+	ShutdownTimeoutMs		int				// the time in ms the in-flight requests are waited for on shutdown
+	Storage        			string 			// the storage backend: "redis" (default), "sql", "memory" or "file"
+	StorageFile    			string 			// the path of the file of the "file" storage
+	SQLDriver      			string 			// the driver of the "sql" storage: postgres, mysql or sqlite3
+	SQLDSN         			string 			// the data source name of the "sql" storage
+	RedisMode      			string 			// "standalone" (default), "sentinel" or "cluster"
 	RedisHost      			string 			// the host of the redis node
 	RedisPort      			int    			// the port of the redis node
 	RedisDB        			int 			// the redis database
 	RedisPassword  			string 			// the password for redis
+	RedisKeyPrefix 			string 			// the prefix of all the redis keys of the service
+	RedisMasterName			string			// the name of the master monitored by the sentinels
+	RedisSentinelAddrs		[]string		// the host:port addresses of the sentinels
+	RedisClusterAddrs		[]string		// the host:port addresses of the cluster seed nodes
+	Tenants					[]Tenant		// the business units sharing the deployment, resolved by the host of the requests
 }
 
 // Load a YAML config file and put values in a Config object
@@ -42,12 +87,55 @@ func LoadConfigYAML(filename string) (*Config, error) {
 	if os.Getenv("HOST")!="" {
 		viper.Set("host", os.Getenv("HOST"))
 	}
+	// the lists are comma separated in the environment variables
+	if os.Getenv("DOMAINS")!="" {
+		viper.Set("domains", strings.Split(os.Getenv("DOMAINS"), ","))
+	}
 	if os.Getenv("PORT")!="" {
 		viper.Set("port", os.Getenv("PORT"))
 	}
 	if os.Getenv("PROTO")!="" {
 		viper.Set("proto", os.Getenv("PROTO"))
 	}
+	if os.Getenv("ADMIN_SECRET")!="" {
+		viper.Set("adminSecret", os.Getenv("ADMIN_SECRET"))
+	}
+	if os.Getenv("REQUIRE_API_KEY")!="" {
+		viper.Set("requireApiKey", os.Getenv("REQUIRE_API_KEY"))
+	}
+	if os.Getenv("RATE_LIMIT_SHARED")!="" {
+		viper.Set("rateLimitShared", os.Getenv("RATE_LIMIT_SHARED"))
+	}
+	if os.Getenv("GEOIP_FILE")!="" {
+		viper.Set("geoipFile", os.Getenv("GEOIP_FILE"))
+	}
+	if os.Getenv("BOT_PATTERNS_FILE")!="" {
+		viper.Set("botPatternsFile", os.Getenv("BOT_PATTERNS_FILE"))
+	}
+	if os.Getenv("CLICK_EXPORT_FILE")!="" {
+		viper.Set("clickExportFile", os.Getenv("CLICK_EXPORT_FILE"))
+	}
+	if os.Getenv("CLICK_WEBHOOK_URL")!="" {
+		viper.Set("clickWebhookUrl", os.Getenv("CLICK_WEBHOOK_URL"))
+	}
+	if os.Getenv("CLICK_EXPORT_IP_KEY")!="" {
+		viper.Set("clickExportIPKey", os.Getenv("CLICK_EXPORT_IP_KEY"))
+	}
+	if os.Getenv("STORAGE")!="" {
+		viper.Set("storage", os.Getenv("STORAGE"))
+	}
+	if os.Getenv("STORAGE_FILE")!="" {
+		viper.Set("storageFile", os.Getenv("STORAGE_FILE"))
+	}
+	if os.Getenv("SQL_DRIVER")!="" {
+		viper.Set("sqlDriver", os.Getenv("SQL_DRIVER"))
+	}
+	if os.Getenv("SQL_DSN")!="" {
+		viper.Set("sqlDSN", os.Getenv("SQL_DSN"))
+	}
+	if os.Getenv("REDIS_MODE")!="" {
+		viper.Set("redisMode", os.Getenv("REDIS_MODE"))
+	}
 	if os.Getenv("REDIS_PORT_6379_TCP_PORT")!="" {
 		viper.Set("redisPort", os.Getenv("REDIS_PORT_6379_TCP_PORT"))
 	}
@@ -60,18 +148,186 @@ func LoadConfigYAML(filename string) (*Config, error) {
 	if os.Getenv("REDIS_PASSWORD")!="" {
 		viper.Set("redisPassword", os.Getenv("REDIS_PASSWORD"))
 	}
+	if os.Getenv("REDIS_KEY_PREFIX")!="" {
+		viper.Set("redisKeyPrefix", os.Getenv("REDIS_KEY_PREFIX"))
+	}
+	if os.Getenv("REDIS_MASTER_NAME")!="" {
+		viper.Set("redisMasterName", os.Getenv("REDIS_MASTER_NAME"))
+	}
+	// the lists of addresses are comma separated in the environment variables
+	if os.Getenv("REDIS_SENTINEL_ADDRS")!="" {
+		viper.Set("redisSentinelAddrs", strings.Split(os.Getenv("REDIS_SENTINEL_ADDRS"), ","))
+	}
+	if os.Getenv("REDIS_CLUSTER_ADDRS")!="" {
+		viper.Set("redisClusterAddrs", strings.Split(os.Getenv("REDIS_CLUSTER_ADDRS"), ","))
+	}
 
 	config := Config{
 		TokenLength:			viper.GetInt("tokenLength"),
 		ReachTimeoutMs:			viper.GetInt("reachTimeoutMs"),
 		ExpirationTimeMonths: 	viper.GetInt("expirationTimeMonths"),
+		MaxExpirationMonths: 	viper.GetInt("maxExpirationMonths"),
+		MaxLinksPerDay:			viper.GetInt("maxLinksPerDay"),
 		Host:					viper.GetString("host"),
+		Domains:				viper.GetStringSlice("domains"),
 		Port:					viper.GetInt("port"),
 		Proto:					viper.GetString("proto"),
+		RedirectStatus:			viper.GetInt("redirectStatus"),
+		AdminSecret:			viper.GetString("adminSecret"),
+		RequireAPIKey:			viper.GetBool("requireApiKey"),
+		HourlyStatsRetentionDays:	viper.GetInt("hourlyStatsRetentionDays"),
+		DailyStatsRetentionDays:	viper.GetInt("dailyStatsRetentionDays"),
+		GeoIPFile:				viper.GetString("geoipFile"),
+		BotPatternsFile:		viper.GetString("botPatternsFile"),
+		TrustForwardedFor:		viper.GetBool("trustForwardedFor"),
+		CreateRateLimitPerIP:	viper.GetInt("createRateLimitPerIP"),
+		CreateRateLimitPerKey:	viper.GetInt("createRateLimitPerKey"),
+		AdminRateLimitPerIP:	viper.GetInt("adminRateLimitPerIP"),
+		AdminRateLimitPerKey:	viper.GetInt("adminRateLimitPerKey"),
+		RateLimitShared:		viper.GetBool("rateLimitShared"),
+		ClickBufferSize:		viper.GetInt("clickBufferSize"),
+		ClickWorkers:			viper.GetInt("clickWorkers"),
+		ClickBatchSize:			viper.GetInt("clickBatchSize"),
+		ClickFlushIntervalMs:	viper.GetInt("clickFlushIntervalMs"),
+		ClickOverflowPolicy:	viper.GetString("clickOverflowPolicy"),
+		ClickExportFile:		viper.GetString("clickExportFile"),
+		ClickExportFileMaxMB:	viper.GetInt("clickExportFileMaxMB"),
+		ClickExportFileBackups:	viper.GetInt("clickExportFileBackups"),
+		ClickWebhookUrl:		viper.GetString("clickWebhookUrl"),
+		ClickWebhookTimeoutMs:	viper.GetInt("clickWebhookTimeoutMs"),
+		ClickExportBufferSize:	viper.GetInt("clickExportBufferSize"),
+		ClickExportBatchSize:	viper.GetInt("clickExportBatchSize"),
+		ClickExportFlushIntervalMs:	viper.GetInt("clickExportFlushIntervalMs"),
+		ClickExportRetries:		viper.GetInt("clickExportRetries"),
+		ClickExportIPKey:		viper.GetString("clickExportIPKey"),
+		ReadyTimeoutMs:			viper.GetInt("readyTimeoutMs"),
+		ShutdownDelayMs:		viper.GetInt("shutdownDelayMs"),
+		ShutdownTimeoutMs:		viper.GetInt("shutdownTimeoutMs"),
+		Storage:				viper.GetString("storage"),
+		StorageFile:			viper.GetString("storageFile"),
+		SQLDriver:				viper.GetString("sqlDriver"),
+		SQLDSN:					viper.GetString("sqlDSN"),
+		RedisMode:				viper.GetString("redisMode"),
 		RedisHost: 				viper.GetString("redisHost"),
 		RedisPort: 				viper.GetInt("redisPort"),
 		RedisDB:	 			viper.GetInt("redisDB"),
-		RedisPassword:			viper.GetString("redisPassword")}
+		RedisPassword:			viper.GetString("redisPassword"),
+		RedisKeyPrefix:			viper.GetString("redisKeyPrefix"),
+		RedisMasterName:		viper.GetString("redisMasterName"),
+		RedisSentinelAddrs:		viper.GetStringSlice("redisSentinelAddrs"),
+		RedisClusterAddrs:		viper.GetStringSlice("redisClusterAddrs")}
+
+	// 301 was the only status code before it could be configured
+	if config.RedirectStatus == 0 {
+		config.RedirectStatus = 301
+	}
+	if config.HourlyStatsRetentionDays == 0 {
+		config.HourlyStatsRetentionDays = 7
+	}
+	if config.DailyStatsRetentionDays == 0 {
+		config.DailyStatsRetentionDays = 365
+	}
+	// the anonymous requests are only served if explicitly allowed
+	if !viper.IsSet("requireApiKey") {
+		config.RequireAPIKey = true
+	}
+	// the submitted urls are checked with an outbound request: the creations are limited by default
+	if !viper.IsSet("createRateLimitPerIP") {
+		config.CreateRateLimitPerIP = 30
+	}
+	if !viper.IsSet("createRateLimitPerKey") {
+		config.CreateRateLimitPerKey = 300
+	}
+	if !viper.IsSet("adminRateLimitPerIP") {
+		config.AdminRateLimitPerIP = 300
+	}
+	if !viper.IsSet("adminRateLimitPerKey") {
+		config.AdminRateLimitPerKey = 1200
+	}
+	// the clicks were recorded during the redirections before the buffer
+	if !viper.IsSet("clickBufferSize") {
+		config.ClickBufferSize = 10000
+	}
+	if config.ClickWorkers == 0 {
+		config.ClickWorkers = 2
+	}
+	if config.ClickBatchSize == 0 {
+		config.ClickBatchSize = 100
+	}
+	if config.ClickFlushIntervalMs == 0 {
+		config.ClickFlushIntervalMs = 1000
+	}
+	if config.ClickOverflowPolicy == "" {
+		config.ClickOverflowPolicy = "drop-newest"
+	}
+	if config.ClickExportFileMaxMB == 0 {
+		config.ClickExportFileMaxMB = 100
+	}
+	if !viper.IsSet("clickExportFileBackups") {
+		config.ClickExportFileBackups = 5
+	}
+	if config.ClickWebhookTimeoutMs == 0 {
+		config.ClickWebhookTimeoutMs = 5000
+	}
+	if config.ClickExportBufferSize == 0 {
+		config.ClickExportBufferSize = 10000
+	}
+	if config.ClickExportBatchSize == 0 {
+		config.ClickExportBatchSize = 500
+	}
+	if config.ClickExportFlushIntervalMs == 0 {
+		config.ClickExportFlushIntervalMs = 5000
+	}
+	if !viper.IsSet("clickExportRetries") {
+		config.ClickExportRetries = 3
+	}
+	if config.ReadyTimeoutMs == 0 {
+		config.ReadyTimeoutMs = 1000
+	}
+	if !viper.IsSet("shutdownDelayMs") {
+		config.ShutdownDelayMs = 5000
+	}
+	if config.ShutdownTimeoutMs == 0 {
+		config.ShutdownTimeoutMs = 30000
+	}
+	if !IsRedirectStatus(config.RedirectStatus) {
+		log.WithField("redirectStatus", config.RedirectStatus).Error("invalid redirect status")
+		return nil, errors.New("invalid redirect status")
+	}
+
+	switch config.ClickOverflowPolicy {
+	case "drop-newest", "drop-oldest", "block":
+	default:
+		log.WithField("clickOverflowPolicy", config.ClickOverflowPolicy).Error("invalid click overflow policy")
+		return nil, errors.New("invalid click overflow policy")
+	}
+	if config.ClickBufferSize < 0 || config.ClickWorkers < 0 || config.ClickBatchSize < 0 {
+		log.Error("negative click buffer size, workers or batch size")
+		return nil, errors.New("invalid click recording configuration")
+	}
+	if config.CreateRateLimitPerIP < 0 || config.CreateRateLimitPerKey < 0 || config.AdminRateLimitPerIP < 0 || config.AdminRateLimitPerKey < 0 {
+		log.Error("negative rate limit")
+		return nil, errors.New("invalid rate limits")
+	}
+	if config.MaxLinksPerDay < 0 {
+		log.Error("negative quota of links")
+		return nil, errors.New("invalid quota of links")
+	}
+
+	// the tenants are read once the top level values they default to are set
+	if err := loadTenants(&config); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
+
+// IsRedirectStatus checks that the status code can be used for the redirections
+func IsRedirectStatus(status int) bool {
+	switch status {
+	case 301, 302, 307, 308:
+		return true
+	default:
+		return false
+	}
+}
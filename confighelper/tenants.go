@@ -0,0 +1,211 @@
+package confighelper
+
+import (
+	"errors"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/spf13/viper"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// DefaultTenantName is the name of the tenant of the requests whose host is not the domain
+// of a configured tenant, configured by the top level values
+const DefaultTenantName = "default"
+
+// the names and namespaces of the tenants are part of the keys of the stores
+var tenantNamePattern = regexp.MustCompile("^[0-9a-zA-Z_-]{1,32}$")
+
+// the maximum length of the namespace of a domain, so that the tokens and owners prefixed
+// by the namespace fit in the 64 characters of the columns of the SQL store
+const maxNamespaceLength = 40
+
+// Tenant is a business unit sharing the deployment, with its own short domains and tokens
+type Tenant struct {
+	Name                 string   // identifies the tenant in the logs and quotas
+	Domains              []string // the short domains of the tenant, the first one is the default one
+	Namespace            string   // the namespace of the tokens of the first domain, empty for the default tenant
+	Proto                string   // the protocol of the short urls
+	Port                 int      // the port of the short urls
+	ExpirationTimeMonths int      // the number of months before a short url is deleted
+	MaxLinksPerDay       int      // the number of links that can be created per day, 0 for no quota
+}
+
+// TenantOf returns the tenant of the host of a request, with or without port. The default
+// tenant, configured by the top level values, is returned for the unknown hosts
+func (c *Config) TenantOf(host string) *Tenant {
+	host = normalizeDomain(host)
+	for i := range c.Tenants {
+		for _, domain := range c.Tenants[i].Domains {
+			if domain == host {
+				return &c.Tenants[i]
+			}
+		}
+	}
+	return c.DefaultTenant()
+}
+
+// DefaultTenant returns the tenant configured by the top level values
+func (c *Config) DefaultTenant() *Tenant {
+	return &Tenant{
+		Name:                 DefaultTenantName,
+		Domains:              c.defaultDomains(),
+		Proto:                c.Proto,
+		Port:                 c.Port,
+		ExpirationTimeMonths: c.ExpirationTimeMonths,
+		MaxLinksPerDay:       c.MaxLinksPerDay,
+	}
+}
+
+// LookupTenant returns the tenant of the name, false if there is no tenant of the name
+func (c *Config) LookupTenant(name string) (*Tenant, bool) {
+	if name == DefaultTenantName {
+		return c.DefaultTenant(), true
+	}
+	for i := range c.Tenants {
+		if c.Tenants[i].Name == name {
+			return &c.Tenants[i], true
+		}
+	}
+	return nil, false
+}
+
+// Domain returns the domain of the short urls of the tenant for a request to the host: the
+// host itself if it is a domain of the tenant, its first domain otherwise
+func (t *Tenant) Domain(host string) string {
+	if domain, ok := t.LookupDomain(host); ok {
+		return domain
+	}
+	return t.Domains[0]
+}
+
+// LookupDomain returns the domain of the tenant matching the host, false if the host is not
+// a domain of the tenant
+func (t *Tenant) LookupDomain(host string) (string, bool) {
+	host = normalizeDomain(host)
+	for _, domain := range t.Domains {
+		if domain == host {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// NamespaceOf returns the namespace of the tokens of a domain of the tenant, so that each
+// domain has its own tokens. The first domain keeps the namespace of the tenant, for the
+// tokens created before the other domains
+func (t *Tenant) NamespaceOf(domain string) string {
+	if domain == t.Domains[0] {
+		return t.Namespace
+	}
+	// the namespaces of the tenants have no @, they can not collide with the ones of the domains
+	return t.Namespace + "@" + domain
+}
+
+// the domains of the default tenant: the host, then the other allowed domains
+func (c *Config) defaultDomains() []string {
+	host := normalizeDomain(c.Host)
+	domains := []string{host}
+	for _, domain := range c.Domains {
+		if normalizeDomain(domain) != host {
+			domains = append(domains, normalizeDomain(domain))
+		}
+	}
+	return domains
+}
+
+// loadTenants reads the tenants of the config, the values they do not set are the top
+// level ones
+func loadTenants(config *Config) error {
+	// the domains of the default tenant can not be the ones of another tenant
+	domains := map[string]string{}
+	defaultTenant := config.DefaultTenant()
+	for _, domain := range defaultTenant.Domains {
+		if err := checkNamespace(DefaultTenantName, defaultTenant.NamespaceOf(domain)); err != nil {
+			return err
+		}
+		domains[normalizeDomain(domain)] = DefaultTenantName
+	}
+
+	if !viper.IsSet("tenants") {
+		return nil
+	}
+	if err := viper.UnmarshalKey("tenants", &config.Tenants); err != nil {
+		log.WithError(err).Error("can not read the tenants")
+		return errors.New("invalid tenants")
+	}
+
+	names := map[string]bool{DefaultTenantName: true}
+	namespaces := map[string]bool{}
+	for i := range config.Tenants {
+		tenant := &config.Tenants[i]
+		if tenant.Namespace == "" {
+			tenant.Namespace = tenant.Name
+		}
+		if tenant.Proto == "" {
+			tenant.Proto = config.Proto
+		}
+		if tenant.Port == 0 {
+			tenant.Port = config.Port
+		}
+		if tenant.ExpirationTimeMonths == 0 {
+			tenant.ExpirationTimeMonths = config.ExpirationTimeMonths
+		}
+
+		if !tenantNamePattern.MatchString(tenant.Name) || !tenantNamePattern.MatchString(tenant.Namespace) {
+			log.WithFields(log.Fields{
+				"tenant":    tenant.Name,
+				"namespace": tenant.Namespace}).Error("invalid tenant name or namespace, only letters, digits, - and _ are allowed")
+			return errors.New("invalid tenant name")
+		}
+		if names[tenant.Name] || namespaces[tenant.Namespace] {
+			log.WithField("tenant", tenant.Name).Error("duplicate tenant name or namespace")
+			return errors.New("duplicate tenant")
+		}
+		names[tenant.Name] = true
+		namespaces[tenant.Namespace] = true
+
+		if len(tenant.Domains) == 0 {
+			log.WithField("tenant", tenant.Name).Error("tenant without domain")
+			return errors.New("tenant without domain")
+		}
+		for j, domain := range tenant.Domains {
+			domain = normalizeDomain(domain)
+			if other, ok := domains[domain]; ok {
+				log.WithFields(log.Fields{
+					"domain":  domain,
+					"tenants": []string{other, tenant.Name}}).Error("domain of several tenants")
+				return errors.New("domain of several tenants")
+			}
+			domains[domain] = tenant.Name
+			tenant.Domains[j] = domain
+			if err := checkNamespace(tenant.Name, tenant.NamespaceOf(domain)); err != nil {
+				return err
+			}
+		}
+		if tenant.MaxLinksPerDay < 0 {
+			log.WithField("tenant", tenant.Name).Error("negative quota of links")
+			return errors.New("invalid tenant quota")
+		}
+	}
+	return nil
+}
+
+// checkNamespace checks that the namespace of a domain is not too long for the stores
+func checkNamespace(tenant string, namespace string) error {
+	if len(namespace) > maxNamespaceLength {
+		log.WithFields(log.Fields{
+			"tenant":    tenant,
+			"namespace": namespace}).Error("domain too long for the namespace of its tokens")
+		return errors.New("domain too long")
+	}
+	return nil
+}
+
+// normalizeDomain lowercases the host and removes its port, if any
+func normalizeDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
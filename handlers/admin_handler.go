@@ -4,20 +4,34 @@ import (
 	"encoding/json"
 	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
-	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
 	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
 	"net/http"
+	"strconv"
 )
 
 // the structure of a response
 type admin_response_body struct {
-	Url          string `json:"url"`
-	CreationTime string `json:"creationTime"`
-	Count        string `json:"count"`
+	Url            string       `json:"url"`
+	CreationTime   string       `json:"creationTime"`
+	Count          string       `json:"count"`
+	BotCount       string       `json:"botCount"`       // the visits of the bots, not in count
+	UniqueVisitors string       `json:"uniqueVisitors"` // estimated, within a few percents
+	ExpiresAt      string       `json:"expiresAt"`      // empty for the permanent links
+	Permanent      bool         `json:"permanent"`
+	RedirectStatus int          `json:"redirectStatus"`
+	Owner          string       `json:"owner"`   // the ID of the API key which created the link
+	History        []admin_edit `json:"history"` // the previous urls, oldest first
+}
+
+// a previous url of the link in the response
+type admin_edit struct {
+	Url      string `json:"url"`
+	EditTime string `json:"editTime"`
 }
 
 // factory to create the handler
-func AdminHandler(redisClient *redis.Client, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+func AdminHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -28,27 +42,62 @@ func AdminHandler(redisClient *redis.Client, conf *confighelper.Config) func(w h
 		vars := mux.Vars(r)
 		token := vars["token"]
 
-		// get the redirection url for this token
-		value, err := redisClient.HGetAllMap(token).Result()
-		if err != nil && err.Error() != "redis: nil" {
-			log.WithError(err).Error("error while retrieving the token infos from redis")
-			w.WriteHeader(500) // server error
+		// the token is looked up in the namespace of the short domain of the request
+		linkStore, ok := tenantStore(w, r, linkStore, conf)
+		if !ok {
 			return
-		} else if value == nil {
-			// "redis: nil" is the error is the key is not found
+		}
+
+		// get the information stored for this token
+		link, err := linkStore.GetLink(token)
+		if err == store.ErrNotFound {
 			log.WithField("token", token).Info("token not found")
 			w.WriteHeader(404) // not found
 			return
+		} else if err != nil {
+			log.WithError(err).Error("error while retrieving the token infos from the store")
+			w.WriteHeader(500) // server error
+			return
 		}
 
 		log.WithFields(log.Fields{
 			"token": token,
-			"value": value}).Debug("mapped values retrieved")
+			"link":  link}).Debug("link retrieved")
+
+		visitors, err := linkStore.CountVisitors(token)
+		if err == store.ErrNotFound {
+			// deleted in the meantime
+			log.WithField("token", token).Info("token not found")
+			w.WriteHeader(404) // not found
+			return
+		} else if err != nil {
+			log.WithError(err).Error("error while counting the unique visitors")
+			w.WriteHeader(500) // server error
+			return
+		}
 
 		response := admin_response_body{
-			Url:          value["url"],
-			CreationTime: value["creationTime"],
-			Count:        value["count"],
+			Url:            link.Url,
+			CreationTime:   strconv.FormatInt(link.CreationTime, 10),
+			Count:          strconv.FormatInt(link.Count, 10),
+			BotCount:       strconv.FormatInt(link.BotCount, 10),
+			UniqueVisitors: strconv.FormatInt(visitors, 10),
+			Permanent:      link.Expiration == 0,
+			RedirectStatus: link.RedirectStatus,
+			Owner:          link.Owner,
+			History:        []admin_edit{},
+		}
+		if response.RedirectStatus == 0 {
+			response.RedirectStatus = conf.RedirectStatus
+		}
+		if link.Expiration != 0 {
+			response.ExpiresAt = strconv.FormatInt(link.Expiration, 10)
+		}
+		for _, edit := range link.History {
+			response.History = append(response.History, admin_edit{
+				Url:      edit.Url,
+				EditTime: strconv.FormatInt(edit.EditTime, 10),
+			})
 		}
 
 		encoder := json.NewEncoder(w)
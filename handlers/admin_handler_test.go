@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+	linkStore.RecordClicks([]store.Click{
+		{Token: "abc123", Time: time.Now(), Fingerprint: "visitor"},
+		{Token: "abc123", Time: time.Now(), Bot: true},
+	}, nil)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", AdminHandler(linkStore, testConf))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/abc123", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatal("Wrong status code: got", w.Code)
+	}
+	var body admin_response_body
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal("Invalid JSON response:", err)
+	}
+	if body.Url != "http://google.com/" || body.Count != "1" || body.UniqueVisitors != "1" || body.BotCount != "1" {
+		t.Error("Wrong response: got", body)
+	}
+	if body.Permanent || body.ExpiresAt != strconv.FormatInt(testExpiration.Unix(), 10) {
+		t.Error("Wrong expiration: got", body.ExpiresAt, body.Permanent)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/zzz999", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Error("Wrong status code for unknown token: got", w.Code)
+	}
+}
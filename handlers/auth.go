@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/context"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the scopes of the API keys
+const (
+	ScopeCreate     = "create"      // create links
+	ScopeReadStats  = "read-stats"  // read the information and statistics of the links
+	ScopeManage     = "manage"      // update and delete links, create permanent links
+	ScopeSuperAdmin = "super-admin" // access the links of all the owners
+)
+
+// Scopes are all the scopes an API key can have
+var Scopes = []string{ScopeCreate, ScopeReadStats, ScopeManage, ScopeSuperAdmin}
+
+// errInvalidKey is returned when the bearer token is not a valid API key
+var errInvalidKey = errors.New("invalid API key")
+
+// the identity of the requests authenticated with the admin secret, with all the scopes
+var adminKey = store.APIKey{ID: "admin", Name: "admin secret", Scopes: Scopes}
+
+// the type of the keys of the values set in the context of the requests, kept with the
+// variables of the router until the end of the request
+type contextKey int
+
+// the API key the request was authenticated with
+const apiKeyContextKey contextKey = 0
+
+// RequireScope wraps a handler so that it is only served to the requests authenticated
+// with an API key of the scope, or with the admin secret, as bearer token:
+// "Authorization: Bearer <key>". The key must be the one of the tenant of the host of the
+// request. Unless the API keys are required, the requests without bearer token are served
+// too for the scopes other than manage. The key is available to the handler with APIKeyOf
+func RequireScope(linkStore store.LinkStore, conf *confighelper.Config, scope string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		bearer := bearerToken(r)
+		if bearer == "" && !conf.RequireAPIKey && scope != ScopeManage {
+			// anonymous request
+			handler(w, r)
+			return
+		}
+
+		key, err := authenticate(linkStore, conf, bearer)
+		if err == errInvalidKey {
+			log.WithField("path", r.URL.Path).Error("unauthenticated request, returning 401: Unauthorized")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(401)
+			return
+		} else if err != nil {
+			log.WithError(err).Error("error while retrieving the API key from the store")
+			w.WriteHeader(500) // server error
+			return
+		}
+
+		if !key.HasScope(scope) {
+			log.WithFields(log.Fields{
+				"apiKey": key.ID,
+				"scope":  scope}).Error("API key without the scope, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		}
+		if tenant, _, _ := tenantDomain(conf, r, ""); !keyOfTenant(key, tenant) {
+			log.WithFields(log.Fields{
+				"apiKey": key.ID,
+				"tenant": tenant.Name}).Error("API key of another tenant, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		}
+
+		log.WithField("apiKey", key.ID).Debug("request authenticated")
+		context.Set(r, apiKeyContextKey, key)
+		handler(w, r)
+	}
+}
+
+// RequireOwner wraps a handler of the link of the token of the path so that it is only
+// served to the owner of the link, or to the API keys of the super-admin scope. The links
+// without owner are served to all the requests, but not to the keys of another tenant. The
+// missing links get a 403 like the links of the other owners, unless the request can access
+// all the links, so that the tokens in use can not be probed. The request must be
+// authenticated by RequireScope first
+func RequireOwner(linkStore store.LinkStore, conf *confighelper.Config, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		token := mux.Vars(r)["token"]
+		if tenant, _, _ := tenantDomain(conf, r, ""); !canAccessTenant(r, tenant) {
+			log.WithFields(log.Fields{
+				"token":  token,
+				"tenant": tenant.Name}).Error("API key of another tenant, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		}
+
+		linkStore, ok := tenantStore(w, r, linkStore, conf)
+		if !ok {
+			return
+		}
+		link, err := linkStore.GetLink(token)
+		if err == store.ErrNotFound && canAccessAll(r) {
+			log.WithField("token", token).Info("token not found")
+			w.WriteHeader(404) // not found
+			return
+		} else if err == store.ErrNotFound {
+			log.WithField("token", token).Error("token not found, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		} else if err != nil {
+			log.WithError(err).Error("error while retrieving the owner of the link from the store")
+			w.WriteHeader(500) // server error
+			return
+		}
+
+		if !canAccess(r, link.Owner) {
+			log.WithFields(log.Fields{
+				"token": token,
+				"owner": link.Owner}).Error("link of another owner, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// APIKeyOf returns the API key the request was authenticated with by RequireScope,
+// nil if the request is anonymous
+func APIKeyOf(r *http.Request) *store.APIKey {
+	key, _ := context.Get(r, apiKeyContextKey).(*store.APIKey)
+	return key
+}
+
+// IssueKey creates an API key of the tenant with the scopes and stores the hash of its
+// secret. The returned key is to be given to its user: it can not be retrieved afterwards
+func IssueKey(linkStore store.LinkStore, tenant *confighelper.Tenant, name string, scopes []string) (string, *store.APIKey, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("an API key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !isScope(scope) {
+			return "", nil, errors.New("unknown scope: " + scope)
+		}
+	}
+
+	// the ID is the public part of the key, to find it in the store
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := store.APIKey{
+		ID:           id,
+		Name:         name,
+		Tenant:       tenant.Name,
+		Hash:         hashSecret(secret),
+		Scopes:       scopes,
+		CreationTime: time.Now().Unix(),
+	}
+	if err := linkStore.AddKey(key); err != nil {
+		return "", nil, err
+	}
+	return id + "." + secret, &key, nil
+}
+
+// authenticate returns the API key of the bearer token, the admin key for the admin
+// secret, or errInvalidKey
+func authenticate(linkStore store.LinkStore, conf *confighelper.Config, bearer string) (*store.APIKey, error) {
+	if conf.AdminSecret != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(conf.AdminSecret)) == 1 {
+		key := adminKey
+		return &key, nil
+	}
+
+	// the keys are written <id>.<secret>
+	parts := strings.SplitN(bearer, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidKey
+	}
+	key, err := linkStore.GetKey(parts[0])
+	if err == store.ErrNotFound {
+		return nil, errInvalidKey
+	} else if err != nil {
+		return nil, err
+	}
+	// constant time comparison to not leak the hash through the response time
+	if key.Revoked() || subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(key.Hash)) != 1 {
+		return nil, errInvalidKey
+	}
+	return key, nil
+}
+
+// canAccess checks that the request can access the links of the owner: it is authenticated
+// with the API key of the owner or of the super-admin scope, or the links have no owner
+func canAccess(r *http.Request, owner string) bool {
+	if owner == "" {
+		return true
+	}
+	key := APIKeyOf(r)
+	return key != nil && (key.ID == owner || canAccessAll(r))
+}
+
+// canAccessAll checks that the request can access the links of all the owners: it is
+// authenticated with an API key of the super-admin scope or with the admin secret
+func canAccessAll(r *http.Request) bool {
+	key := APIKeyOf(r)
+	return key != nil && key.HasScope(ScopeSuperAdmin)
+}
+
+// canAccessTenant checks that the request is anonymous or authenticated with an API key of
+// the tenant
+func canAccessTenant(r *http.Request, tenant *confighelper.Tenant) bool {
+	key := APIKeyOf(r)
+	return key == nil || keyOfTenant(key, tenant)
+}
+
+// keyOfTenant checks that the API key was issued for the tenant. The admin secret is valid
+// for all the tenants, and the keys issued before the tenants for the default tenant
+func keyOfTenant(key *store.APIKey, tenant *confighelper.Tenant) bool {
+	if key.ID == adminKey.ID {
+		return true
+	}
+	if key.Tenant == "" {
+		return tenant.Name == confighelper.DefaultTenantName
+	}
+	return key.Tenant == tenant.Name
+}
+
+// hasScope checks that the request is authenticated with an API key of the scope
+// or with the admin secret
+func hasScope(r *http.Request, conf *confighelper.Config, scope string) bool {
+	if key := APIKeyOf(r); key != nil && key.HasScope(scope) {
+		return true
+	}
+	return hasSecret(r, conf.AdminSecret)
+}
+
+// hasSecret checks that the request is authenticated with the secret as bearer token
+func hasSecret(r *http.Request, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	// constant time comparison to not leak the secret through the response time
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(secret)) == 1
+}
+
+// bearerToken returns the bearer token of the Authorization header, empty if none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// hashSecret hashes the secret of an API key: the secrets are random and long enough
+// for a fast hash to be safe
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func isScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// send a request with the given authorization header to the handler, returns the
+// status code and the API key seen by the handler
+func authenticated(handler func(scope string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request),
+	scope string, authorization string) (int, *store.APIKey) {
+
+	var key *store.APIKey
+	h := handler(scope, func(w http.ResponseWriter, r *http.Request) {
+		key = APIKeyOf(r)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/abc123", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	h(w, req)
+	return w.Code, key
+}
+
+// the configuration of the tests of the admin routes, with the admin secret "secret"
+func adminConf() *confighelper.Config {
+	conf := *testConf
+	conf.AdminSecret = "secret"
+	return &conf
+}
+
+// adminRoute wraps the handler of an admin route of a token as it is served: authenticated
+// with a key of the scope, then restricted to the owner of the link
+func adminRoute(linkStore store.LinkStore, conf *confighelper.Config, scope string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return RequireScope(linkStore, conf, scope, RequireOwner(linkStore, conf, handler))
+}
+
+func TestRequireScope(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	conf := *testConf
+	conf.AdminSecret = "secret"
+	requireScope := func(scope string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return RequireScope(linkStore, &conf, scope, next)
+	}
+
+	creator, _, err := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeCreate})
+	if err != nil {
+		t.Fatal("Could not issue a key:", err)
+	}
+	revoked, revokedKey, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-b", Scopes)
+	linkStore.RevokeKey(revokedKey.ID)
+
+	// the anonymous requests are served unless the keys are required, but never for manage
+	if code, key := authenticated(requireScope, ScopeCreate, ""); code != 200 || key != nil {
+		t.Error("Anonymous request not served: got", code, key)
+	}
+	if code, _ := authenticated(requireScope, ScopeManage, ""); code != 401 {
+		t.Error("Anonymous request served for manage: got", code)
+	}
+
+	if code, key := authenticated(requireScope, ScopeCreate, "Bearer "+creator); code != 200 || key == nil || key.Name != "team-a" {
+		t.Error("Request with a key not served: got", code, key)
+	}
+	if code, _ := authenticated(requireScope, ScopeReadStats, "Bearer "+creator); code != 403 {
+		t.Error("Request served without the scope: got", code)
+	}
+	if code, _ := authenticated(requireScope, ScopeCreate, "Bearer "+creator+"x"); code != 401 {
+		t.Error("Request served with a wrong secret: got", code)
+	}
+	if code, _ := authenticated(requireScope, ScopeCreate, "Bearer "+revoked); code != 401 {
+		t.Error("Request served with a revoked key: got", code)
+	}
+	if code, _ := authenticated(requireScope, ScopeCreate, "Bearer unknown"); code != 401 {
+		t.Error("Request served with an unknown key: got", code)
+	}
+
+	// the admin secret has all the scopes
+	if code, key := authenticated(requireScope, ScopeManage, "Bearer secret"); code != 200 || key == nil || key.ID != "admin" {
+		t.Error("Request with the admin secret not served: got", code, key)
+	}
+
+	conf.RequireAPIKey = true
+	if code, _ := authenticated(requireScope, ScopeCreate, ""); code != 401 {
+		t.Error("Anonymous request served with the keys required: got", code)
+	}
+}
+
+func TestRequireScopeRouterVariables(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+	manager, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeManage})
+
+	// the token of the path is still seen by the handler of an authenticated request
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", RequireScope(linkStore, testConf, ScopeManage, DeleteHandler(linkStore, testConf)))
+	if code := deleteLink(r, "abc123", "Bearer "+manager); code != 204 {
+		t.Error("Wrong status code: got", code)
+	}
+}
+
+func TestIssueKey(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	if _, _, err := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{"admin"}); err == nil {
+		t.Error("Key issued with an unknown scope")
+	}
+	if _, _, err := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", nil); err == nil {
+		t.Error("Key issued without scope")
+	}
+
+	key, apiKey, err := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeCreate, ScopeReadStats})
+	if err != nil {
+		t.Fatal("Could not issue a key:", err)
+	}
+	// only the hash of the secret is stored
+	stored, err := linkStore.GetKey(apiKey.ID)
+	if err != nil || stored.Hash == "" || stored.Hash == key[len(apiKey.ID)+1:] || len(stored.Scopes) != 2 {
+		t.Error("Wrong stored key: got", stored, err)
+	}
+}
+
+func TestRequireOwner(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	owner, ownerKey, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeManage})
+	other, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-b", []string{ScopeManage})
+	admin, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "ops", []string{ScopeManage, ScopeSuperAdmin})
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix(), Owner: ownerKey.ID})
+	linkStore.Reserve("def456", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", RequireScope(linkStore, testConf, ScopeManage,
+		RequireOwner(linkStore, testConf, DeleteHandler(linkStore, testConf))))
+
+	if code := deleteLink(r, "abc123", "Bearer "+other); code != 403 {
+		t.Error("Link deleted by another owner: got", code)
+	}
+	if code := deleteLink(r, "abc123", "Bearer "+owner); code != 204 {
+		t.Error("Link not deleted by its owner: got", code)
+	}
+	// the missing tokens are only told apart from the links of the other owners to the
+	// keys which can access all the links
+	if code := deleteLink(r, "abc123", "Bearer "+owner); code != 403 {
+		t.Error("Wrong status code for a deleted token: got", code)
+	}
+	if code := deleteLink(r, "abc123", "Bearer "+admin); code != 404 {
+		t.Error("Wrong status code for a deleted token with the super-admin scope: got", code)
+	}
+	// the links without owner are managed by all the keys of the scope
+	if code := deleteLink(r, "def456", "Bearer "+other); code != 204 {
+		t.Error("Link without owner not deleted: got", code)
+	}
+
+	linkStore.Reserve("ghi789", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix(), Owner: ownerKey.ID})
+	if code := deleteLink(r, "ghi789", "Bearer "+admin); code != 204 {
+		t.Error("Link not deleted by a super-admin: got", code)
+	}
+}
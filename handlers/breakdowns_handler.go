@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"strconv"
+)
+
+// the number of values returned by dimension, by default and at most
+const defaultBreakdownTop = 10
+const maxBreakdownTop = 100
+
+// the structure of a response: the top values by dimension
+type breakdowns_response_body map[string][]breakdown_entry
+
+// a value of a dimension and its number of clicks in the response
+type breakdown_entry struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// factory to create the handler
+func BreakdownsHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// debug log
+		log.WithField("request", r).Debug("breakdowns request received")
+
+		// get the path variable to get the token
+		vars := mux.Vars(r)
+		token := vars["token"]
+
+		// the token is looked up in the namespace of the short domain of the request
+		linkStore, ok := tenantStore(w, r, linkStore, conf)
+		if !ok {
+			return
+		}
+
+		// all the dimensions, unless one is requested
+		query := r.URL.Query()
+		dimensions := store.Dimensions
+		if query.Get("dimension") != "" {
+			dimension, err := store.ParseDimension(query.Get("dimension"))
+			if err != nil {
+				log.WithField("dimension", query.Get("dimension")).Error("invalid dimension in breakdowns request, returning 400: Bad Request")
+				w.WriteHeader(400)
+				return
+			}
+			dimensions = []store.Dimension{dimension}
+		}
+		top := defaultBreakdownTop
+		if query.Get("top") != "" {
+			var err error
+			top, err = strconv.Atoi(query.Get("top"))
+			if err != nil || top < 1 || top > maxBreakdownTop {
+				log.WithField("top", query.Get("top")).Error("invalid top in breakdowns request, returning 400: Bad Request")
+				w.WriteHeader(400)
+				return
+			}
+		}
+
+		response := breakdowns_response_body{}
+		for _, dimension := range dimensions {
+			entries, err := linkStore.GetBreakdown(token, dimension, top)
+			if err == store.ErrNotFound {
+				log.WithField("token", token).Info("token not found")
+				w.WriteHeader(404) // not found
+				return
+			} else if err != nil {
+				log.WithError(err).Error("error while retrieving the breakdowns from the store")
+				w.WriteHeader(500) // server error
+				return
+			}
+			response[string(dimension)] = []breakdown_entry{}
+			for _, entry := range entries {
+				response[string(dimension)] = append(response[string(dimension)], breakdown_entry{
+					Value: entry.Value,
+					Count: entry.Count,
+				})
+			}
+		}
+
+		// avoid caching the page on the client side, the breakdowns change with each click
+		w.Header().Set("cache-control", "private, max-age=0, no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+		log.WithField("token", token).Info("breakdowns request served")
+	}
+}
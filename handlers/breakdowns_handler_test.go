@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBreakdowns(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, testConf, testAnalyzer, clickhelper.NewRecorder(linkStore, testConf)))
+	r.HandleFunc("/admin/{token}/breakdowns", BreakdownsHandler(linkStore, testConf))
+
+	// the breakdowns are recorded by the redirections
+	for _, referer := range []string{"https://t.co/x", "https://t.co/y", "https://www.google.com/", ""} {
+		req, _ := http.NewRequest("GET", "/abc123", nil)
+		req.Header.Set("Referer", referer)
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/abc123/breakdowns?top=2", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatal("Wrong status code: got", w.Code)
+	}
+	var body breakdowns_response_body
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal("Invalid JSON response:", err)
+	}
+	if len(body) != len(store.Dimensions) {
+		t.Error("Wrong dimensions: got", body)
+	}
+	referrers := body["referrer"]
+	if len(referrers) != 2 || referrers[0] != (breakdown_entry{"t.co", 2}) || referrers[1].Count != 1 {
+		t.Error("Wrong referrers: got", referrers)
+	}
+	if browsers := body["browser"]; len(browsers) != 1 || browsers[0] != (breakdown_entry{"Firefox", 4}) {
+		t.Error("Wrong browsers: got", browsers)
+	}
+	if countries := body["country"]; len(countries) != 1 || countries[0] != (breakdown_entry{"unknown", 4}) {
+		t.Error("Wrong countries: got", countries)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/abc123/breakdowns?dimension=os", nil)
+	r.ServeHTTP(w, req)
+	body = breakdowns_response_body{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != 200 || len(body) != 1 || len(body["os"]) != 1 || body["os"][0].Value != "Linux" {
+		t.Error("Wrong response for a dimension: got", w.Code, body)
+	}
+
+	for _, query := range []string{"dimension=language", "top=0", "top=1000", "top=abc"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/admin/abc123/breakdowns?"+query, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Error("Wrong status code for", query, "got", w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/zzz999/breakdowns", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Error("Wrong status code for unknown token: got", w.Code)
+	}
+}
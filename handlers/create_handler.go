@@ -3,9 +3,10 @@ package handlers
 import (
 	"encoding/json"
 	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
-	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
 	"github.com/BenoitHanotte/shorturls/confighelper"
 	"github.com/BenoitHanotte/shorturls/mathhelper"
+	"github.com/BenoitHanotte/shorturls/metrics"
+	"github.com/BenoitHanotte/shorturls/store"
 	"github.com/BenoitHanotte/shorturls/urlhelper"
 	"math/rand"
 	"net/http"
@@ -20,13 +21,26 @@ const retriesToRaiseOffset = 3 // if after X retries there is still token collis
 // make random part of the token longer by 1 character
 const maxRetries = 20 // the number of retries before giving up (too many collisions)
 
+// the number of tokens which were already used when creating the links
+var tokenCollisions = metrics.NewCounterVec("shorturls_token_collisions_total",
+	"The number of generated or suggested tokens which were already used, each one causing a retry.")
+
+// the paths of the server which can not be used as tokens (links for /admin/links),
+// the routes are matched first
+var reservedTokens = map[string]bool{"metrics": true, "healthz": true, "readyz": true, "links": true}
+
 // available characters to generate random strings
 const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 // the structure of a request (unmarshalled from JSON)
 type create_request_body struct {
-	Url   string // the url to shorten
-	Token string // the requested personalisation, CAN BE NOT SET
+	Url            string // the url to shorten
+	Token          string // the requested personalisation, CAN BE NOT SET
+	Domain         string // the short domain of the link, CAN BE NOT SET
+	ExpiresAt      string // the expiration time (RFC 3339), CAN BE NOT SET
+	Ttl            string // the time to live (eg: 72h), CAN BE NOT SET
+	Permanent      bool   // the link never expires, requires the manage scope
+	RedirectStatus int    // the status code of the redirections, CAN BE NOT SET
 }
 
 // the structure of a response (marshalled to JSON)
@@ -40,7 +54,7 @@ func init() {
 }
 
 // factory to create the handler
-func CreateHandler(redisClient *redis.Client, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+func CreateHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// log request for debugging purposes (eg: crash, ...)
@@ -68,6 +82,15 @@ func CreateHandler(redisClient *redis.Client, conf *confighelper.Config) func(w
 			return
 		}
 
+		// the link is created in the namespace of its short domain, the tokens are unique by domain
+		tenant, domain, ok := tenantDomain(conf, r, body.Domain)
+		if !ok {
+			log.WithField("domain", body.Domain).Error("domain of another tenant in create request, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+		linkStore := store.WithNamespace(linkStore, tenant.NamespaceOf(domain))
+
 		// check that URL is reachable (no intranet, no tor url, ...)
 		if !urlhelper.IsReachable(body.Url, conf.ReachTimeoutMs) {
 			log.WithField("url", body.Url).Error("unreachable URL submitted, returning 400 bad request")
@@ -82,6 +105,52 @@ func CreateHandler(redisClient *redis.Client, conf *confighelper.Config) func(w
 			return
 		}
 
+		// the expiration requested for the link, or the default one
+		expiration, err := linkExpiration(body, tenant, conf, time.Now())
+		if err != nil {
+			log.WithError(err).Error("invalid expiration, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+		if body.Permanent && !hasScope(r, conf, ScopeManage) {
+			log.Error("permanent link requested without the manage scope, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		}
+
+		// the status code of the redirections, the default one is used if not set
+		if body.RedirectStatus != 0 && !confighelper.IsRedirectStatus(body.RedirectStatus) {
+			log.WithField("redirectStatus", body.RedirectStatus).Error("invalid redirect status, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+
+		// the link is owned by the API key of the request, if any
+		owner := ""
+		if key := APIKeyOf(r); key != nil {
+			owner = key.ID
+		}
+
+		// the quota of links of the tenant, shared by all the servers. The link is counted
+		// before its token is reserved, and given back if it can not be created
+		now := time.Now()
+		counted := false
+		if tenant.MaxLinksPerDay > 0 {
+			allowed, retryAfter, err := withinQuota(linkStore, tenant, now)
+			if err != nil {
+				log.WithError(err).Error("can not count the link in the quota of the tenant, aborting")
+				w.WriteHeader(500)
+				return
+			}
+			if !allowed {
+				log.WithField("tenant", tenant.Name).Error("quota of links of the tenant reached, returning 429: Too Many Requests")
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+				w.WriteHeader(429)
+				return
+			}
+			counted = true
+		}
+
 		// create a random token generator
 		randomTokenGenerator := randomTokenGenerator(body.Token, conf.TokenLength);
 		var token string
@@ -92,44 +161,57 @@ func CreateHandler(redisClient *redis.Client, conf *confighelper.Config) func(w
 			if err != nil {
 				// we tried to generate too many token, abort
 				log.WithError(err).Error("too many collisions for token, aborting")
+				if counted {
+					refundQuota(linkStore, tenant, now)
+				}
 				w.WriteHeader(500)
 				return
 			}
 
-			// use HSetNX to get lock on the Token
-			lockAcquired, err := redisClient.HSetNX(token, "url", body.Url).Result()
-			if lockAcquired {
-				// debug log
-				log.WithField("token", token).Debug("lock was acquired")
-
-				// lock could be acquired: we reserved the token !
-				// proceed by setting other fields
-				_, err = redisClient.HMSet(token, "creationTime", strconv.FormatInt(time.Now().Unix(), 10),
-					"count", "0").Result()
-				// set expiration time in 3 months
-				redisClient.ExpireAt(token, time.Now().AddDate(0, conf.ExpirationTimeMonths, 0))
-				break;	// leave the loop: don't try to generate a new token
+			if reservedTokens[token] {
+				log.WithField("token", token).Debug("reserved token, retrying if allowed")
+				continue
 			}
 
-			// if there was an error while setting in the map (more than just key already present)
+			// try to get the lock on the token
+			lockAcquired, err := linkStore.Reserve(token, store.Link{
+				Url:            body.Url,
+				Expiration:     store.UnixOrZero(expiration),
+				RedirectStatus: body.RedirectStatus,
+				Owner:          owner,
+			})
+
+			// if there was an error while reserving the token (more than just token already used)
 			if err != nil {
-				log.WithError(err).Error("can not set the entry in Redis, aborting")
+				log.WithError(err).Error("can not reserve the token in the store, aborting")
+				if counted {
+					refundQuota(linkStore, tenant, now)
+				}
 				w.WriteHeader(500)
 				return
 			}
 
+			if lockAcquired {
+				// debug log
+				log.WithField("token", token).Debug("lock was acquired")
+				break;	// leave the loop: don't try to generate a new token
+			}
+
 			// debug log
 			log.WithField("token", token).Debug("could not acquire lock, retrying if allowed")
+			tokenCollisions.Inc()
 		}
 
 		// log success
 		log.WithFields(log.Fields{
-			"url":   body.Url,
-			"token": token}).Info("new short link created")
+			"url":    body.Url,
+			"token":  token,
+			"domain": domain,
+			"tenant": tenant.Name}).Info("new short link created")
 
 		// generate response
 		response := create_response_body{
-			Url: urlhelper.Build(conf.Proto, conf.Host, conf.Port, token),
+			Url: urlhelper.Build(tenant.Proto, domain, tenant.Port, token),
 		}
 
 		w.WriteHeader(201) // return 201: created
@@ -144,6 +226,84 @@ func validateToken(token string, tokenLength int) bool {
 	return match
 }
 
+// compute the expiration of the link from the expiresAt or ttl of the request, bounded
+// by MaxExpirationMonths. Without them, the link expires after the ExpirationTimeMonths
+// of the tenant. The zero time is returned for the permanent links
+func linkExpiration(body create_request_body, tenant *confighelper.Tenant, conf *confighelper.Config, now time.Time) (time.Time, error) {
+	if body.ExpiresAt != "" && body.Ttl != "" {
+		return time.Time{}, errors.New("expiresAt and ttl can not be both set")
+	}
+
+	if body.Permanent {
+		if body.ExpiresAt != "" || body.Ttl != "" {
+			return time.Time{}, errors.New("a permanent link has no expiration")
+		}
+		return time.Time{}, nil
+	}
+
+	var expiration time.Time
+	switch {
+	case body.ExpiresAt != "":
+		var err error
+		expiration, err = time.Parse(time.RFC3339, body.ExpiresAt)
+		if err != nil {
+			return time.Time{}, err
+		}
+	case body.Ttl != "":
+		ttl, err := time.ParseDuration(body.Ttl)
+		if err != nil {
+			return time.Time{}, err
+		}
+		expiration = now.Add(ttl)
+	default:
+		return now.AddDate(0, tenant.ExpirationTimeMonths, 0), nil
+	}
+
+	if !expiration.After(now) {
+		return time.Time{}, errors.New("expiration in the past")
+	}
+	// the default expiration is the maximum if no maximum is configured
+	maxMonths := conf.MaxExpirationMonths
+	if maxMonths == 0 {
+		maxMonths = tenant.ExpirationTimeMonths
+	}
+	if expiration.After(now.AddDate(0, maxMonths, 0)) {
+		return time.Time{}, errors.New("expiration after the maximum of " + strconv.Itoa(maxMonths) + " months")
+	}
+	return expiration, nil
+}
+
+// count a new link in the quota of the tenant for the day (UTC). Once the quota is reached,
+// false is returned with the time until the next day, and the link is not counted
+func withinQuota(linkStore store.LinkStore, tenant *confighelper.Tenant, now time.Time) (bool, time.Duration, error) {
+	counter, next := quotaCounter(tenant, now)
+	count, err := linkStore.IncrementCounter(counter, next)
+	if err != nil {
+		return false, 0, err
+	}
+	if count > int64(tenant.MaxLinksPerDay) {
+		refundQuota(linkStore, tenant, now)
+		return false, next.Sub(now), nil
+	}
+	return true, next.Sub(now), nil
+}
+
+// give back a link counted in the quota of the tenant by withinQuota at the time, for the
+// links which could not be created
+func refundQuota(linkStore store.LinkStore, tenant *confighelper.Tenant, now time.Time) {
+	counter, _ := quotaCounter(tenant, now)
+	if err := linkStore.DecrementCounter(counter); err != nil {
+		log.WithError(err).WithField("tenant", tenant.Name).Error("can not give back the link to the quota of the tenant")
+	}
+}
+
+// the name of the counter of the quota of the tenant for the day of the time, and the end
+// of the day
+func quotaCounter(tenant *confighelper.Tenant, now time.Time) (string, time.Time) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	return "links:" + tenant.Name + ":" + day.Format("20060102"), day.Add(24 * time.Hour)
+}
+
 // Factory to create a function which generates random token
 func randomTokenGenerator(suggestion string, tokenLength int) func() (string, error) {
 
@@ -1,8 +1,19 @@
 package handlers
 
 import (
-	"testing"
+	"encoding/json"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/alicebob/miniredis/v2"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
+	"testing"
+	"time"
 )
 
 type token struct {
@@ -65,4 +76,270 @@ func TestGenerateToken(t *testing.T) {
 		ok, msg := validToken(orig, got, err, 6)
 		if !ok { t.Error(msg) }
 	}
-}
\ No newline at end of file
+}
+
+// the expiration used for the links created in the tests
+var testExpiration = time.Now().AddDate(0, 3, 0)
+
+// the configuration used to test the handlers
+var testConf = &confighelper.Config{
+	TokenLength:          6,
+	ReachTimeoutMs:       2000,
+	ExpirationTimeMonths: 3,
+	Host:                 "myhost.com",
+	Port:                 80,
+	Proto:                "http",
+	RedirectStatus:       301,
+
+	HourlyStatsRetentionDays: 7,
+	DailyStatsRetentionDays:  365,
+	// no ClickBufferSize: the clicks are recorded during the redirections
+}
+
+// the analyzer of the clicks used to test the handlers, without GeoIP database
+var testAnalyzer = &clickhelper.Analyzer{}
+
+// create a short url through the create handler, returns the response
+func postShortlink(handler http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/shortlink", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateAndRedirect(t *testing.T) {
+	// the server the short url redirects to, it must be reachable
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/shortlink", CreateHandler(linkStore, testConf))
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, testConf, testAnalyzer, clickhelper.NewRecorder(linkStore, testConf)))
+
+	w := postShortlink(r, `{"url": "`+target.URL+`/page", "token": "choice"}`)
+	if w.Code != 201 {
+		t.Fatal("Wrong status code: got", w.Code)
+	}
+	var body create_response_body
+	json.NewDecoder(w.Body).Decode(&body)
+	if body.Url != "http://myhost.com/choice" {
+		t.Fatal("Wrong short url: got", body.Url)
+	}
+
+	// the same suggestion gives another token
+	collisions := tokenCollisions.Value()
+	w = postShortlink(r, `{"url": "`+target.URL+`/other", "token": "choice"}`)
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != 201 || body.Url == "http://myhost.com/choice" {
+		t.Error("Token reused: got", w.Code, body.Url)
+	}
+	// the random character of the retry can collide again
+	if tokenCollisions.Value() < collisions+1 {
+		t.Error("Collision not counted: got", tokenCollisions.Value()-collisions)
+	}
+
+	// the paths of the server are not given as tokens
+	w = postShortlink(r, `{"url": "`+target.URL+`/other", "token": "readyz"}`)
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != 201 || body.Url == "http://myhost.com/readyz" {
+		t.Error("Reserved token used: got", w.Code, body.Url)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/choice", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != 301 || w.Header().Get("Location") != target.URL+"/page" {
+		t.Error("Wrong redirection: got", w.Code, w.Header().Get("Location"))
+	}
+
+	// invalid requests
+	if w = postShortlink(r, `{"url": "not an url"}`); w.Code != 400 {
+		t.Error("Invalid url accepted: got", w.Code)
+	}
+	if w = postShortlink(r, `{"url": "`+target.URL+`", "token": "to-long-token"}`); w.Code != 400 {
+		t.Error("Invalid token accepted: got", w.Code)
+	}
+	if w = postShortlink(r, `{"url": "`+target.URL+`", "redirectStatus": 200}`); w.Code != 400 {
+		t.Error("Invalid redirect status accepted: got", w.Code)
+	}
+
+	// the redirect status is stored with the link
+	w = postShortlink(r, `{"url": "`+target.URL+`", "token": "temp01", "redirectStatus": 307}`)
+	if link, _ := linkStore.GetLink("temp01"); w.Code != 201 || link.RedirectStatus != 307 {
+		t.Error("Redirect status not stored: got", w.Code, link)
+	}
+}
+
+func TestCreateAndRedirectRedis(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	// the scripts of the redis store run in an in-memory redis
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal("Could not start redis:", err)
+	}
+	defer server.Close()
+	linkStore := store.NewRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}), "shorturls")
+	defer linkStore.Close()
+
+	conf := *adminConf()
+	conf.MaxLinksPerDay = 2
+	r := mux.NewRouter()
+	r.HandleFunc("/shortlink", CreateHandler(linkStore, &conf))
+	r.HandleFunc("/admin/{token}", adminRoute(linkStore, &conf, ScopeManage, UpdateHandler(linkStore, &conf))).Methods("PATCH")
+	r.HandleFunc("/admin/{token}", adminRoute(linkStore, &conf, ScopeManage, DeleteHandler(linkStore, &conf))).Methods("DELETE")
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, &conf, testAnalyzer, clickhelper.NewRecorder(linkStore, &conf)))
+
+	// the link is created with its expiration, the same suggestion gives another token
+	if w := postShortlink(r, `{"url": "`+target.URL+`/page", "token": "choice"}`); w.Code != 201 {
+		t.Fatal("Wrong status code: got", w.Code)
+	}
+	if ttl := server.TTL("shorturls:v1:link:choice"); ttl <= 0 {
+		t.Error("Link created without expiration: got", ttl)
+	}
+	w := postShortlink(r, `{"url": "`+target.URL+`/other", "token": "choice"}`)
+	var body create_response_body
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != 201 || body.Url == "http://myhost.com/choice" {
+		t.Error("Token reused: got", w.Code, body.Url)
+	}
+
+	// the clicks are recorded in the count, statistics and breakdowns of the link
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/choice", nil)
+		req.Header.Set("Referer", "http://example.com/")
+		r.ServeHTTP(w, req)
+		if w.Code != 301 || w.Header().Get("Location") != target.URL+"/page" {
+			t.Error("Wrong redirection: got", w.Code, w.Header().Get("Location"))
+		}
+	}
+	if link, err := linkStore.GetLink("choice"); err != nil || link.Count != 2 {
+		t.Error("Clicks not counted: got", link, err)
+	}
+	if buckets, err := linkStore.GetStats("choice", store.Hourly, time.Now().Add(-time.Hour), time.Now()); err != nil ||
+		len(buckets) != 1 || buckets[0].Count != 2 {
+		t.Error("Wrong stats: got", buckets, err)
+	}
+	if entries, err := linkStore.GetBreakdown("choice", store.Referrer, 10); err != nil ||
+		len(entries) != 1 || entries[0].Count != 2 {
+		t.Error("Wrong breakdown: got", entries, err)
+	}
+
+	// the url is updated with its history, then the link is replaced by a tombstone
+	if code := updateLink(r, "choice", `{"url": "`+target.URL+`/new"}`); code != 204 {
+		t.Error("Wrong status code for the update: got", code)
+	}
+	if link, _ := linkStore.GetLink("choice"); link == nil || len(link.History) != 1 || link.History[0].Url != target.URL+"/page" {
+		t.Error("Wrong history: got", link)
+	}
+	if code := deleteLink(r, "choice", "Bearer secret"); code != 204 {
+		t.Error("Wrong status code for the delete: got", code)
+	}
+	if w := postShortlink(r, `{"url": "`+target.URL+`", "token": "choice"}`); w.Code != 429 {
+		// the 2 links of the quota are created
+		t.Error("Quota of the links not enforced: got", w.Code)
+	}
+	if ok, _ := linkStore.Reserve("choice", store.Link{Url: target.URL, Expiration: testExpiration.Unix()}); ok {
+		t.Error("Deleted token re-issued")
+	}
+
+	// the API keys are added once and revoked
+	key, apiKey, err := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeCreate})
+	if err != nil || key == "" {
+		t.Fatal("Could not issue a key:", err)
+	}
+	if err := linkStore.AddKey(*apiKey); err != store.ErrKeyExists {
+		t.Error("Key added twice: got", err)
+	}
+	linkStore.RevokeKey(apiKey.ID)
+	if stored, _ := linkStore.GetKey(apiKey.ID); stored == nil || !stored.Revoked() {
+		t.Error("Key not revoked: got", stored)
+	}
+}
+
+func TestLinkExpiration(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	conf := &confighelper.Config{ExpirationTimeMonths: 3, MaxExpirationMonths: 12}
+
+	var expirations = []struct {
+		body     create_request_body
+		expected time.Time // the zero time for permanent links
+		errorExp bool
+	}{
+		{create_request_body{}, now.AddDate(0, 3, 0), false},
+		{create_request_body{Ttl: "72h"}, now.Add(72 * time.Hour), false},
+		{create_request_body{ExpiresAt: "2016-06-01T00:00:00Z"}, time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{create_request_body{Permanent: true}, time.Time{}, false},
+		{create_request_body{Ttl: "72h", ExpiresAt: "2016-06-01T00:00:00Z"}, time.Time{}, true},
+		{create_request_body{Ttl: "72h", Permanent: true}, time.Time{}, true},
+		{create_request_body{Ttl: "3 days"}, time.Time{}, true},
+		{create_request_body{Ttl: "-1h"}, time.Time{}, true},
+		{create_request_body{ExpiresAt: "2018-01-01T00:00:00Z"}, time.Time{}, true},
+		{create_request_body{ExpiresAt: "01/06/2016"}, time.Time{}, true},
+	}
+
+	for _, exp := range expirations {
+		got, err := linkExpiration(exp.body, conf.TenantOf(""), conf, now)
+		if exp.errorExp && err == nil {
+			t.Error("Should have raised error: for", exp.body, "got", got)
+		} else if !exp.errorExp && (err != nil || !got.Equal(exp.expected)) {
+			t.Error("For", exp.body, "got", got, err, "expected", exp.expected)
+		}
+	}
+}
+
+func TestCreatePermanent(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	conf := *testConf
+	conf.AdminSecret = "secret"
+	handler := CreateHandler(linkStore, &conf)
+
+	// permanent links require the admin secret
+	w := postShortlink(http.HandlerFunc(handler), `{"url": "`+target.URL+`", "token": "perm01", "permanent": true}`)
+	if w.Code != 403 {
+		t.Error("Permanent link created without the secret: got", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/shortlink", strings.NewReader(`{"url": "`+target.URL+`", "token": "perm01", "permanent": true}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	handler(w, req)
+	if w.Code != 201 {
+		t.Fatal("Wrong status code: got", w.Code)
+	}
+	link, _ := linkStore.GetLink("perm01")
+	if link == nil || link.Expiration != 0 {
+		t.Error("Link not permanent: got", link)
+	}
+
+	// or an API key of the manage scope
+	creator, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeCreate})
+	manager, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-b", []string{ScopeCreate, ScopeManage})
+	authenticated := RequireScope(linkStore, &conf, ScopeCreate, handler)
+	for key, code := range map[string]int{creator: 403, manager: 201} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/shortlink", strings.NewReader(`{"url": "`+target.URL+`", "token": "perm02", "permanent": true}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		authenticated(w, req)
+		if w.Code != code {
+			t.Error("Wrong status code for a permanent link with an API key: got", w.Code)
+		}
+	}
+
+	// the link is owned by the key which created it
+	managerKey, _ := linkStore.GetKey(manager[:strings.Index(manager, ".")])
+	if link, _ := linkStore.GetLink("perm02"); link == nil || link.Owner != managerKey.ID {
+		t.Error("Wrong owner: got", link)
+	}
+}
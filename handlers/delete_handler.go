@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+)
+
+// factory to create the handler
+func DeleteHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// debug log
+		log.WithField("request", r).Debug("delete request received")
+
+		// get the path variable to get the token
+		vars := mux.Vars(r)
+		token := vars["token"]
+
+		// the token is looked up in the namespace of the short domain of the request
+		linkStore, ok := tenantStore(w, r, linkStore, conf)
+		if !ok {
+			return
+		}
+
+		// the store keeps a tombstone so that the token is not re-issued right away
+		err := linkStore.Delete(token)
+		if err == store.ErrNotFound {
+			log.WithField("token", token).Info("token not found")
+			w.WriteHeader(404) // not found
+			return
+		} else if err != nil {
+			log.WithError(err).Error("error while deleting the token from the store")
+			w.WriteHeader(500) // server error
+			return
+		}
+
+		w.WriteHeader(204) // no content
+
+		log.WithField("token", token).Info("short link deleted")
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// send a delete request with the given authorization header, returns the status code
+func deleteLink(handler http.Handler, token string, authorization string) int {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/admin/"+token, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestDelete(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	conf := adminConf()
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", adminRoute(linkStore, conf, ScopeManage, DeleteHandler(linkStore, conf)))
+
+	if code := deleteLink(r, "abc123", ""); code != 401 {
+		t.Error("Unauthenticated delete: got", code)
+	}
+	if code := deleteLink(r, "abc123", "Bearer wrong"); code != 401 {
+		t.Error("Delete with a wrong secret: got", code)
+	}
+	if code := deleteLink(r, "abc123", "Bearer secret"); code != 204 {
+		t.Error("Wrong status code: got", code)
+	}
+	if code := deleteLink(r, "abc123", "Bearer secret"); code != 404 {
+		t.Error("Wrong status code for a deleted token: got", code)
+	}
+
+	// the tombstone keeps the token used
+	if _, err := linkStore.GetRedirection("abc123"); err != store.ErrNotFound {
+		t.Error("Deleted token still redirects, error:", err)
+	}
+	if ok, _ := linkStore.Reserve("abc123", store.Link{Url: "http://example.com/", Expiration: testExpiration.Unix()}); ok {
+		t.Error("Deleted token re-issued")
+	}
+}
+
+func TestDeleteWithoutSecret(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	// without admin secret, the empty bearer token is not accepted as the secret
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", adminRoute(linkStore, testConf, ScopeManage, DeleteHandler(linkStore, testConf)))
+
+	if code := deleteLink(r, "abc123", "Bearer "); code != 401 {
+		t.Error("Delete allowed without secret configured: got", code)
+	}
+}
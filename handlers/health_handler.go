@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errPingTimeout is returned when the store does not answer the ping in time
+var errPingTimeout = errors.New("storage ping timed out")
+
+// the structure of a readiness response: the result of each check
+type ready_response_body struct {
+	Status string            `json:"status"` // "ok" or "failing"
+	Checks map[string]string `json:"checks"` // "ok" or the error of each check
+}
+
+// Readiness tells if the server accepts traffic, it fails once the shutdown started
+// so that the load balancers stop sending requests before the server exits
+type Readiness struct {
+	shuttingDown int32 // accessed atomically
+}
+
+// ShutDown makes the readiness checks fail
+func (r *Readiness) ShutDown() {
+	atomic.StoreInt32(&r.shuttingDown, 1)
+}
+
+// ShuttingDown returns true once ShutDown was called
+func (r *Readiness) ShuttingDown() bool {
+	return atomic.LoadInt32(&r.shuttingDown) == 1
+}
+
+// factory to create the liveness handler: the process is alive if it answers
+func HealthHandler() func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("cache-control", "private, max-age=0, no-cache")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// factory to create the readiness handler: the server is ready if the configuration
+// is loaded, the storage answers a ping within ReadyTimeoutMs and it is not shutting down
+func ReadyHandler(linkStore store.LinkStore, conf *confighelper.Config, readiness *Readiness) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		response := ready_response_body{Status: "ok", Checks: map[string]string{}}
+		fail := func(check string, err error) {
+			response.Status = "failing"
+			response.Checks[check] = err.Error()
+		}
+
+		timeout := time.Second
+		if conf == nil {
+			fail("config", errors.New("configuration not loaded"))
+		} else {
+			response.Checks["config"] = "ok"
+			timeout = time.Duration(conf.ReadyTimeoutMs) * time.Millisecond
+		}
+		if err := pingStore(linkStore, timeout); err != nil {
+			log.WithError(err).Error("storage not reachable, not ready")
+			fail("storage", err)
+		} else {
+			response.Checks["storage"] = "ok"
+		}
+		if readiness.ShuttingDown() {
+			fail("shutdown", errors.New("shutting down"))
+		} else {
+			response.Checks["shutdown"] = "ok"
+		}
+
+		w.Header().Set("cache-control", "private, max-age=0, no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		if response.Status != "ok" {
+			w.WriteHeader(503) // service unavailable
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// pingStore pings the store, an error is returned if it does not answer before the
+// timeout. The ping is left running in the background on timeout
+func pingStore(linkStore store.LinkStore, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- linkStore.Ping()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errPingTimeout
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// pingingStore is a store whose pings fail or are slow
+type pingingStore struct {
+	*store.MemoryStore
+	err   error
+	delay time.Duration
+}
+
+func (s *pingingStore) Ping() error {
+	time.Sleep(s.delay)
+	return s.err
+}
+
+func TestHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	HealthHandler()(w, req)
+
+	if w.Code != 200 || w.Body.String() != "ok\n" {
+		t.Error("Wrong liveness response: got", w.Code, w.Body.String())
+	}
+}
+
+func TestReady(t *testing.T) {
+	memoryStore := store.NewMemoryStore()
+	defer memoryStore.Close()
+
+	conf := *testConf
+	conf.ReadyTimeoutMs = 50
+	var ready = []struct {
+		linkStore store.LinkStore
+		shutdown  bool
+		expected  int
+		failing   string // the failing check
+	}{
+		{memoryStore, false, 200, ""},
+		{&pingingStore{memoryStore, errors.New("connection refused"), 0}, false, 503, "storage"},
+		{&pingingStore{memoryStore, nil, time.Second}, false, 503, "storage"},
+		{memoryStore, true, 503, "shutdown"},
+	}
+
+	for _, r := range ready {
+		readiness := &Readiness{}
+		if r.shutdown {
+			readiness.ShutDown()
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		ReadyHandler(r.linkStore, &conf, readiness)(w, req)
+
+		var body ready_response_body
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal("Invalid JSON response:", err)
+		}
+		if w.Code != r.expected {
+			t.Error("Wrong status code: got", w.Code, "expected", r.expected, body)
+		}
+		for check, result := range body.Checks {
+			if (result != "ok") != (check == r.failing) {
+				t.Error("Wrong result of the", check, "check: got", result)
+			}
+		}
+	}
+}
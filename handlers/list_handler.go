@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"github.com/BenoitHanotte/shorturls/urlhelper"
+	"net/http"
+	"strconv"
+)
+
+// the number of links returned by a list request, by default and at most
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// the structure of a response
+type list_response_body struct {
+	Links      []list_link `json:"links"`
+	NextCursor string      `json:"nextCursor"` // the cursor of the next page, empty on the last page
+}
+
+// a link in the response
+type list_link struct {
+	Token          string `json:"token"`
+	ShortUrl       string `json:"shortUrl"`
+	Url            string `json:"url"`
+	CreationTime   string `json:"creationTime"`
+	Count          string `json:"count"`
+	BotCount       string `json:"botCount"`
+	ExpiresAt      string `json:"expiresAt"` // empty for the permanent links
+	Permanent      bool   `json:"permanent"`
+	RedirectStatus int    `json:"redirectStatus"`
+}
+
+// factory to create the handler listing the links of an owner by pages
+func ListHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// debug log
+		log.WithField("request", r).Debug("list request received")
+
+		// the links of the API key of the request by default
+		query := r.URL.Query()
+		owner := query.Get("owner")
+		if owner == "" || owner == "me" {
+			key := APIKeyOf(r)
+			if key == nil {
+				log.Error("links of an anonymous request requested, returning 401: Unauthorized")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(401)
+				return
+			}
+			owner = key.ID
+		}
+		if !canAccess(r, owner) {
+			log.WithField("owner", owner).Error("links of another owner requested, returning 403: Forbidden")
+			w.WriteHeader(403)
+			return
+		}
+
+		limit := defaultListLimit
+		if query.Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > maxListLimit {
+				log.WithField("limit", query.Get("limit")).Error("invalid limit in list request, returning 400: Bad Request")
+				w.WriteHeader(400)
+				return
+			}
+		}
+
+		// the links of the short domain of the request, the host or the domain parameter
+		tenant, domain, ok := tenantDomain(conf, r, query.Get("domain"))
+		if !ok {
+			log.WithField("domain", query.Get("domain")).Error("domain of another tenant requested, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+		links, next, err := store.WithNamespace(linkStore, tenant.NamespaceOf(domain)).ListLinks(owner, query.Get("cursor"), limit)
+		if err != nil {
+			log.WithError(err).Error("error while listing the links from the store")
+			w.WriteHeader(500) // server error
+			return
+		}
+
+		response := list_response_body{Links: []list_link{}, NextCursor: next}
+		for _, link := range links {
+			entry := list_link{
+				Token:          link.Token,
+				ShortUrl:       urlhelper.Build(tenant.Proto, domain, tenant.Port, link.Token),
+				Url:            link.Url,
+				CreationTime:   strconv.FormatInt(link.CreationTime, 10),
+				Count:          strconv.FormatInt(link.Count, 10),
+				BotCount:       strconv.FormatInt(link.BotCount, 10),
+				Permanent:      link.Expiration == 0,
+				RedirectStatus: link.RedirectStatus,
+			}
+			if entry.RedirectStatus == 0 {
+				entry.RedirectStatus = conf.RedirectStatus
+			}
+			if link.Expiration != 0 {
+				entry.ExpiresAt = strconv.FormatInt(link.Expiration, 10)
+			}
+			response.Links = append(response.Links, entry)
+		}
+
+		w.Header().Set("cache-control", "private, max-age=0, no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+		log.WithFields(log.Fields{
+			"owner": owner,
+			"links": len(response.Links)}).Info("list request served")
+	}
+}
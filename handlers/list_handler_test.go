@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// send a list request with the given query and API key, returns the recorder
+func listLinks(handler http.Handler, query string, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/links"+query, nil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestList(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	owner, ownerKey, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeCreate, ScopeReadStats})
+	other, otherKey, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-b", []string{ScopeReadStats})
+	admin, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "ops", []string{ScopeReadStats, ScopeSuperAdmin})
+	for _, token := range []string{"abc123", "abc124", "abc125"} {
+		linkStore.Reserve(token, store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix(), Owner: ownerKey.ID})
+	}
+	linkStore.Reserve("def456", store.Link{Url: "http://example.com/", Owner: otherKey.ID})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/links", RequireScope(linkStore, testConf, ScopeReadStats, ListHandler(linkStore, testConf)))
+
+	// by pages, the links of the key by default
+	w := listLinks(r, "?limit=2", owner)
+	var body list_response_body
+	if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != 200 || err != nil {
+		t.Fatal("Wrong response: got", w.Code, err)
+	}
+	if len(body.Links) != 2 || body.Links[0].Token != "abc123" || body.Links[1].Token != "abc124" || body.NextCursor != "abc124" {
+		t.Error("Wrong first page: got", body)
+	}
+	if body.Links[0].ShortUrl != "http://myhost.com/abc123" || body.Links[0].Permanent || body.Links[0].RedirectStatus != 301 {
+		t.Error("Wrong listed link: got", body.Links[0])
+	}
+
+	w = listLinks(r, "?owner=me&limit=2&cursor="+body.NextCursor, owner)
+	body = list_response_body{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if len(body.Links) != 1 || body.Links[0].Token != "abc125" || body.NextCursor != "" {
+		t.Error("Wrong last page: got", body)
+	}
+
+	// the links of the other owners are only listed to the super-admins
+	if w := listLinks(r, "?owner="+ownerKey.ID, other); w.Code != 403 {
+		t.Error("Links of another owner listed: got", w.Code)
+	}
+	w = listLinks(r, "?owner="+otherKey.ID, admin)
+	body = list_response_body{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 200 || len(body.Links) != 1 || body.Links[0].Token != "def456" || !body.Links[0].Permanent {
+		t.Error("Wrong links listed to a super-admin: got", w.Code, body)
+	}
+
+	if w := listLinks(r, "", ""); w.Code != 401 {
+		t.Error("Links listed to an anonymous request: got", w.Code)
+	}
+	if w := listLinks(r, "?limit=0", owner); w.Code != 400 {
+		t.Error("Wrong status code for an invalid limit: got", w.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the limits are given in requests per minute
+const rateLimitPeriod = time.Minute
+
+// the client of the requests whose address can not be read, limited as a single address
+const unknownClient = "ip:unknown"
+
+// RateLimiter limits the requests of a group of routes by address of the client and by API
+// key. Each client has a token bucket of the size of its limit, refilled continuously at the
+// limit per minute. If shared, the buckets are kept in the store instead, so that the limits
+// hold across the servers
+type RateLimiter struct {
+	name              string          // the group of routes, in the names of the shared buckets
+	perIP             int             // the requests per minute by address, 0 for no limit
+	perKey            int             // the requests per minute by API key, 0 for no limit
+	trustForwardedFor bool            // read the address of the clients from X-Forwarded-For
+	linkStore         store.LinkStore // the store of the shared buckets, nil if not shared
+
+	mutex     sync.Mutex
+	buckets   map[string]*store.TokenBucket // the buckets of the clients by address or API key
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates the limiter of a group of routes, with the limits in requests per
+// minute by address of the client and by API key, 0 for no limit. The requests are counted
+// in the store if RateLimitShared is set
+func NewRateLimiter(linkStore store.LinkStore, conf *confighelper.Config, name string, perIP int, perKey int) *RateLimiter {
+	l := &RateLimiter{
+		name:              name,
+		perIP:             perIP,
+		perKey:            perKey,
+		trustForwardedFor: conf.TrustForwardedFor,
+		buckets:           make(map[string]*store.TokenBucket),
+	}
+	if conf.RateLimitShared {
+		l.linkStore = linkStore
+	}
+	return l
+}
+
+// RateLimit wraps a handler so that the requests over the limit of their address get a
+// 429: Too Many Requests error, with a Retry-After header giving the seconds to wait. The
+// requests whose address can not be read are limited together. The limiter is to be used
+// before RequireScope, so that the requests with invalid keys are limited too
+func RateLimit(limiter *RateLimiter, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if limiter.perIP > 0 {
+			// the requests whose address can not be read share the same bucket
+			client := unknownClient
+			if ip := clickhelper.ClientIP(r, limiter.trustForwardedFor); ip != nil {
+				client = "ip:" + ip.String()
+			}
+			if !limiter.allow(w, client, limiter.perIP) {
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// RateLimitKey wraps a handler so that the requests over the limit of their API key get a
+// 429: Too Many Requests error, with a Retry-After header giving the seconds to wait. The
+// API key is the one authenticated by RequireScope, the limiter is to be used after it. The
+// anonymous requests are not limited
+func RateLimitKey(limiter *RateLimiter, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if key := APIKeyOf(r); key != nil && limiter.perKey > 0 {
+			if !limiter.allow(w, "key:"+key.ID, limiter.perKey) {
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// allow counts a request of the client, it returns false once the 429: Too Many Requests
+// error is written if the client is over its limit
+func (l *RateLimiter) allow(w http.ResponseWriter, client string, limit int) bool {
+	retryAfter, limited := l.limit(client, limit, time.Now())
+	if !limited {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"routes": l.name,
+		"client": client}).Error("rate limit exceeded, returning 429: Too Many Requests")
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	w.WriteHeader(429)
+	return false
+}
+
+// limit counts a request of the client, it returns true with the time to wait if the client
+// is over its limit
+func (l *RateLimiter) limit(client string, limit int, now time.Time) (time.Duration, bool) {
+	if l.linkStore != nil {
+		return l.limitShared(client, limit)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// the buckets unused for a period are full again, they are the same as new ones
+	if now.Sub(l.lastSweep) > rateLimitPeriod {
+		for c, bucket := range l.buckets {
+			if now.Sub(bucket.LastUsed) > rateLimitPeriod {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = store.NewTokenBucket(limit, now)
+		l.buckets[client] = bucket
+	}
+	taken, wait := bucket.Take(limit, rateLimitPeriod, now)
+	return wait, !taken
+}
+
+// limitShared takes a token for the request from the bucket of the client in the store,
+// shared by the servers. The requests are served if the store fails, to not depend on its
+// availability
+func (l *RateLimiter) limitShared(client string, limit int) (time.Duration, bool) {
+	taken, wait, err := l.linkStore.TakeToken("ratelimit:"+l.name+":"+client, limit, rateLimitPeriod)
+	if err != nil {
+		log.WithError(err).Error("can not count the request in the shared rate limits, serving it")
+		return 0, false
+	}
+	return wait, !taken
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// send a request from the address through the handler, returns the response
+func limitedRequest(handler func(w http.ResponseWriter, r *http.Request), addr string, authorization string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/abc123", nil)
+	req.RemoteAddr = addr
+	if authorization != "" {
+		req.Header.Set("Authorization", "Bearer "+authorization)
+	}
+	handler(w, req)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	limiter := NewRateLimiter(linkStore, testConf, "admin", 2, 1)
+	handler := RateLimit(limiter, RequireScope(linkStore, testConf, ScopeReadStats, RateLimitKey(limiter, ok)))
+
+	// the bucket of the address holds 2 requests
+	for i := 0; i < 2; i++ {
+		if w := limitedRequest(handler, "10.0.0.1:1234", ""); w.Code != 200 {
+			t.Fatal("Request limited under the limit: got", w.Code)
+		}
+	}
+	w := limitedRequest(handler, "10.0.0.1:1235", "")
+	if w.Code != 429 {
+		t.Error("Request over the limit of the address served: got", w.Code)
+	}
+	// a token is refilled every 30 seconds at 2 requests per minute
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 29 || retryAfter > 30 {
+		t.Error("Wrong Retry-After: got", w.Header().Get("Retry-After"))
+	}
+	if w := limitedRequest(handler, "10.0.0.2:1234", ""); w.Code != 200 {
+		t.Error("Request of another address limited: got", w.Code)
+	}
+
+	// the requests without a readable address share a bucket
+	for i := 0; i < 2; i++ {
+		if w := limitedRequest(handler, "unix", ""); w.Code != 200 {
+			t.Fatal("Request without address limited under the limit: got", w.Code)
+		}
+	}
+	if w := limitedRequest(handler, "", ""); w.Code != 429 {
+		t.Error("Request without address over the limit served: got", w.Code)
+	}
+
+	// the requests with invalid keys are limited by address too
+	for i := 0; i < 2; i++ {
+		if w := limitedRequest(handler, "10.0.0.5:1234", "0123456789abcdef.guess"); w.Code != 401 {
+			t.Fatal("Wrong status code of an invalid key under the limit: got", w.Code)
+		}
+	}
+	if w := limitedRequest(handler, "10.0.0.5:1234", "0123456789abcdef.guess"); w.Code != 429 {
+		t.Error("Request with an invalid key over the limit of the address served: got", w.Code)
+	}
+
+	// the bucket of the API key holds 1 request, whatever the address
+	key, _, _ := IssueKey(linkStore, testConf.DefaultTenant(), "team-a", []string{ScopeReadStats})
+	if w := limitedRequest(handler, "10.0.0.3:1234", key); w.Code != 200 {
+		t.Error("Request of the key limited under the limit: got", w.Code)
+	}
+	if w := limitedRequest(handler, "10.0.0.4:1234", key); w.Code != 429 {
+		t.Error("Request over the limit of the key served: got", w.Code)
+	}
+
+	// no limit
+	unlimited := RateLimit(NewRateLimiter(linkStore, testConf, "admin", 0, 0), ok)
+	for i := 0; i < 10; i++ {
+		if w := limitedRequest(unlimited, "10.0.0.1:1234", ""); w.Code != 200 {
+			t.Fatal("Request limited without limit: got", w.Code)
+		}
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	limiter := NewRateLimiter(nil, testConf, "admin", 4, 0)
+	start := time.Now()
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	// the bucket holds 4 requests, refilled by a token every 15 seconds
+	for i := 0; i < 4; i++ {
+		if _, limited := limiter.limit("ip:10.0.0.1", 4, start); limited {
+			t.Fatal("Request limited under the limit")
+		}
+	}
+	var refills = []struct {
+		seconds    float64
+		limited    bool
+		retryAfter time.Duration
+	}{
+		{0, true, 15 * time.Second},
+		{10, true, 5 * time.Second},
+		// the fractions of token refilled by the limited requests are kept
+		{15, false, 0},
+		{20, true, 10 * time.Second},
+		{37.5, false, 0},
+		{37.5, true, 7500 * time.Millisecond},
+		// the bucket does not hold more than the limit
+		{600, false, 0},
+		{600, false, 0},
+		{600, false, 0},
+		{600, false, 0},
+		{600, true, 15 * time.Second},
+	}
+	for _, refill := range refills {
+		retryAfter, limited := limiter.limit("ip:10.0.0.1", 4, at(refill.seconds))
+		if limited != refill.limited || (limited && (retryAfter < refill.retryAfter-time.Millisecond || retryAfter > refill.retryAfter)) {
+			t.Error("Wrong limit at", refill.seconds, "s: got", limited, retryAfter, "expected", refill.limited, refill.retryAfter)
+		}
+	}
+}
+
+func TestRateLimitShared(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	conf := *testConf
+	conf.RateLimitShared = true
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	// two servers counting the requests in the same store
+	first := RateLimit(NewRateLimiter(linkStore, &conf, "create", 2, 0), ok)
+	second := RateLimit(NewRateLimiter(linkStore, &conf, "create", 2, 0), ok)
+	if w := limitedRequest(first, "10.0.0.1:1234", ""); w.Code != 200 {
+		t.Fatal("Request limited under the limit: got", w.Code)
+	}
+	if w := limitedRequest(second, "10.0.0.1:1234", ""); w.Code != 200 {
+		t.Fatal("Request limited under the limit: got", w.Code)
+	}
+	w := limitedRequest(first, "10.0.0.1:1234", "")
+	if w.Code != 429 {
+		t.Error("Request over the shared limit served: got", w.Code)
+	}
+	// the shared bucket is refilled by a token every 30 seconds too
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 29 || retryAfter > 30 {
+		t.Error("Wrong Retry-After: got", w.Header().Get("Retry-After"))
+	}
+}
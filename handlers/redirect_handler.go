@@ -3,13 +3,14 @@ package handlers
 import (
 	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
-	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
 	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
 	"net/http"
 )
 
 // factory to create the handler
-func RedirectHandler(redisClient *redis.Client, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+func RedirectHandler(linkStore store.LinkStore, conf *confighelper.Config, analyzer *clickhelper.Analyzer, recorder *clickhelper.Recorder) func(w http.ResponseWriter, r *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// debug log
@@ -19,36 +20,48 @@ func RedirectHandler(redisClient *redis.Client, conf *confighelper.Config) func(
 		vars := mux.Vars(r)
 		token := vars["token"]
 
+		// the token is looked up in the namespace of the short domain of the host
+		tenant := conf.TenantOf(r.Host)
+		domain := tenant.Domain(r.Host)
+		namespace := tenant.NamespaceOf(domain)
+		linkStore := store.WithNamespace(linkStore, namespace)
+
 		// get the redirection url for this token
-		url, err := redisClient.HGet(token, "url").Result()
-		if err != nil && err.Error() != "redis: nil" {
-			log.WithError(err).Error("error while retrieving the redirection url from redis")
-			w.WriteHeader(500) // server error
-			return
-		} else if url == "" {
-			// "redis: nil" is the error is the key is not found
+		redirection, err := linkStore.GetRedirection(token)
+		if err == store.ErrNotFound {
 			log.WithField("token", token).Info("token not found")
 			w.WriteHeader(404) // not found
 			return
+		} else if err != nil {
+			log.WithError(err).Error("error while retrieving the redirection url from the store")
+			w.WriteHeader(500) // server error
+			return
 		}
-		// consider that url in Redis is correct from here
+		// consider that url in the store is correct from here
+
+		// the click is queued to not wait for the store, the bots are counted apart so
+		// that the count only holds the visits of humans
+		click := analyzer.Analyze(r)
+		recorded := recorder.Record(domain, namespace, token, click)
 
-		// increment count
-		count, err := redisClient.HIncrBy(token, "count", 1).Result()
-		if err != nil {
-			log.WithError(err).Error("error while incrementing count")
-			// no server error, we can still redirect the user
+		// the status code of the link, or the default one
+		status := redirection.Status
+		if status == 0 {
+			status = conf.RedirectStatus
 		}
 
 		// redirect
-		w.Header().Set("Location", url)
+		w.Header().Set("Location", redirection.Url)
 		// avoid caching the page on the client side to not bias the counts
 		w.Header().Set("cache-control", "private, max-age=0, no-cache")
-		w.WriteHeader(301) // moved permanently
+		w.WriteHeader(status)
 
 		log.WithFields(log.Fields{
 			"token": 	token,
-			"count": 	count,
-			"url": 		url}).Info("redirect request served")
+			"tenant":	tenant.Name,
+			"bot": 		click.Bot,
+			"recorded":	recorded,
+			"status": 	status,
+			"url": 		redirection.Url}).Info("redirect request served")
 	}
 }
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, testConf, testAnalyzer, clickhelper.NewRecorder(linkStore, testConf)))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/abc123", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 301 {
+		t.Error("Wrong status code: got", w.Code)
+	}
+	if w.Header().Get("Location") != "http://google.com/" {
+		t.Error("Wrong location: got", w.Header().Get("Location"))
+	}
+	if link, _ := linkStore.GetLink("abc123"); link.Count != 1 {
+		t.Error("Count not incremented: got", link.Count)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/zzz999", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Error("Wrong status code for unknown token: got", w.Code)
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("def302", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix(), RedirectStatus: 302})
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	conf := *testConf
+	conf.RedirectStatus = 307
+	r := mux.NewRouter()
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, &conf, testAnalyzer, clickhelper.NewRecorder(linkStore, &conf)))
+
+	// the status code of the link, or the default one
+	for token, expected := range map[string]int{"def302": 302, "abc123": 307} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/"+token, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Error("Wrong status code for", token, "got", w.Code, "expected", expected)
+		}
+	}
+}
+
+func TestRedirectBots(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	analyzer, err := clickhelper.NewAnalyzer("", "../bots.txt", false)
+	if err != nil {
+		t.Fatal("Could not load the bot patterns:", err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, testConf, analyzer, clickhelper.NewRecorder(linkStore, testConf)))
+
+	// a link previewer, a HEAD request and a human
+	requests := []struct{ method, ua string }{
+		{"GET", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"},
+		{"HEAD", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"},
+		{"GET", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"},
+	}
+	for _, request := range requests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(request.method, "/abc123", nil)
+		req.Header.Set("User-Agent", request.ua)
+		r.ServeHTTP(w, req)
+		// the bots are redirected too
+		if w.Code != 301 || w.Header().Get("Location") != "http://google.com/" {
+			t.Error("Wrong redirection for", request, "got", w.Code)
+		}
+	}
+
+	link, _ := linkStore.GetLink("abc123")
+	if link.Count != 1 || link.BotCount != 2 {
+		t.Error("Wrong counts: got", link.Count, link.BotCount)
+	}
+	// the bots are not in the statistics of the humans
+	if visitors, _ := linkStore.CountVisitors("abc123"); visitors != 1 {
+		t.Error("Bots counted as unique visitors: got", visitors)
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the maximum number of buckets returned by a stats request
+const maxStatsBuckets = 1000
+
+// the period returned when the from parameter is not set, by granularity
+var defaultStatsPeriods = map[store.Granularity]time.Duration{
+	store.Hourly: 24 * time.Hour,
+	store.Daily:  30 * 24 * time.Hour,
+}
+
+// the structure of a response
+type stats_response_body struct {
+	Granularity string         `json:"granularity"`
+	From        string         `json:"from"` // the start of the first bucket
+	To          string         `json:"to"`
+	Total       int64          `json:"total"` // the number of clicks in the buckets
+	Buckets     []stats_bucket `json:"buckets"`
+}
+
+// the clicks of an hour or a day in the response, the buckets without clicks are included
+type stats_bucket struct {
+	Start string `json:"start"`
+	Count int64  `json:"count"`
+}
+
+// factory to create the handler
+func StatsHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// debug log
+		log.WithField("request", r).Debug("stats request received")
+
+		// get the path variable to get the token
+		vars := mux.Vars(r)
+		token := vars["token"]
+
+		// the token is looked up in the namespace of the short domain of the request
+		linkStore, ok := tenantStore(w, r, linkStore, conf)
+		if !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		granularity := store.Hourly
+		if query.Get("granularity") != "" {
+			var err error
+			if granularity, err = store.ParseGranularity(query.Get("granularity")); err != nil {
+				log.WithField("granularity", query.Get("granularity")).Error("invalid granularity in stats request, returning 400: Bad Request")
+				w.WriteHeader(400)
+				return
+			}
+		}
+		from, to, err := statsPeriod(query.Get("from"), query.Get("to"), granularity, time.Now())
+		if err != nil {
+			log.WithError(err).Error("invalid period in stats request, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+
+		buckets, err := linkStore.GetStats(token, granularity, from, to)
+		if err == store.ErrNotFound {
+			log.WithField("token", token).Info("token not found")
+			w.WriteHeader(404) // not found
+			return
+		} else if err != nil {
+			log.WithError(err).Error("error while retrieving the stats from the store")
+			w.WriteHeader(500) // server error
+			return
+		}
+
+		response := stats_response_body{
+			Granularity: string(granularity),
+			From:        strconv.FormatInt(from.Unix(), 10),
+			To:          strconv.FormatInt(to.Unix(), 10),
+			Buckets:     []stats_bucket{},
+		}
+		// fill the buckets without clicks so that the series has no gap
+		for start := from; !start.After(to); start = start.Add(granularity.Duration()) {
+			bucket := stats_bucket{Start: strconv.FormatInt(start.Unix(), 10)}
+			for len(buckets) > 0 && buckets[0].Start <= start.Unix() {
+				if buckets[0].Start == start.Unix() {
+					bucket.Count = buckets[0].Count
+				}
+				buckets = buckets[1:]
+			}
+			response.Total += bucket.Count
+			response.Buckets = append(response.Buckets, bucket)
+		}
+
+		// avoid caching the page on the client side, the stats change with each click
+		w.Header().Set("cache-control", "private, max-age=0, no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+		log.WithFields(log.Fields{
+			"token":       token,
+			"granularity": granularity}).Info("stats request served")
+	}
+}
+
+// statsPeriod returns the start of the first and last buckets of the requested period.
+// The times are unix timestamps or RFC 3339 times, to defaults to now and from to
+// a default period before to
+func statsPeriod(fromParam string, toParam string, granularity store.Granularity, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if toParam != "" {
+		var err error
+		if to, err = parseStatsTime(toParam); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	from := to.Add(-defaultStatsPeriods[granularity])
+	if fromParam != "" {
+		var err error
+		if from, err = parseStatsTime(fromParam); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	from, to = granularity.BucketStart(from), granularity.BucketStart(to)
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("from is after to")
+	}
+	if to.Sub(from)/granularity.Duration() >= maxStatsBuckets {
+		return time.Time{}, time.Time{}, errors.New("too many buckets requested")
+	}
+	return from, to, nil
+}
+
+// parseStatsTime parses a unix timestamp or a RFC 3339 time
+func parseStatsTime(param string) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+	return time.Parse(time.RFC3339, param)
+}
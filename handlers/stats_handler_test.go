@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, testConf, testAnalyzer, clickhelper.NewRecorder(linkStore, testConf)))
+	r.HandleFunc("/admin/{token}/stats", StatsHandler(linkStore, testConf))
+
+	// the clicks are recorded by the redirections
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/abc123", nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/abc123/stats?granularity=hour", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatal("Wrong status code: got", w.Code)
+	}
+	var body stats_response_body
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal("Invalid JSON response:", err)
+	}
+	// the default period is the last 24 hours, the buckets without clicks are included
+	if body.Granularity != "hour" || body.Total != 3 || len(body.Buckets) != 25 {
+		t.Fatal("Wrong response: got", body)
+	}
+	last := body.Buckets[len(body.Buckets)-1]
+	if last.Count != 3 || last.Start != strconv.FormatInt(store.Hourly.BucketStart(time.Now()).Unix(), 10) {
+		t.Error("Wrong last bucket: got", last)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/abc123/stats?granularity=day&from=2016-01-01T00:00:00Z&to=2016-01-03T12:00:00Z", nil)
+	r.ServeHTTP(w, req)
+	body = stats_response_body{}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != 200 || len(body.Buckets) != 3 || body.Total != 0 || body.From != "1451606400" {
+		t.Error("Wrong response for a past period: got", w.Code, body)
+	}
+
+	for _, query := range []string{"granularity=minute", "from=yesterday", "from=2016-01-02T00:00:00Z&to=2016-01-01T00:00:00Z",
+		"granularity=hour&from=2015-01-01T00:00:00Z&to=2016-01-01T00:00:00Z"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/admin/abc123/stats?"+query, nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Error("Wrong status code for", query, "got", w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/zzz999/stats", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Error("Wrong status code for unknown token: got", w.Code)
+	}
+}
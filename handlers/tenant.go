@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+)
+
+// tenantDomain returns the tenant of the host of the request and the short domain of the
+// request: the requested domain if set, the host if it is a domain of the tenant, or the
+// first domain of the tenant. False is returned if the requested domain is not a domain of
+// the tenant
+func tenantDomain(conf *confighelper.Config, r *http.Request, requested string) (*confighelper.Tenant, string, bool) {
+	tenant := conf.TenantOf(r.Host)
+	if requested == "" {
+		return tenant, tenant.Domain(r.Host), true
+	}
+	domain, ok := tenant.LookupDomain(requested)
+	return tenant, domain, ok
+}
+
+// tenantStore returns the store of the namespace of the short domain of the request, where
+// its tokens are looked up. The domain is the host of the request, or the domain parameter
+// of the query. If the domain is not one of the tenant of the host, a 400: Bad Request is
+// returned with false
+func tenantStore(w http.ResponseWriter, r *http.Request, linkStore store.LinkStore, conf *confighelper.Config) (store.LinkStore, bool) {
+	tenant, domain, ok := tenantDomain(conf, r, r.URL.Query().Get("domain"))
+	if !ok {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+			"domain": r.URL.Query().Get("domain")}).Error("domain of another tenant requested, returning 400: Bad Request")
+		w.WriteHeader(400)
+		return nil, false
+	}
+	return store.WithNamespace(linkStore, tenant.NamespaceOf(domain)), true
+}
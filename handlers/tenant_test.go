@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/context"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the configuration with the tenants used to test the handlers
+func tenantsConf() *confighelper.Config {
+	conf := *testConf
+	conf.Tenants = []confighelper.Tenant{
+		{Name: "marketing", Domains: []string{"go.example.com", "ex.am"}, Namespace: "marketing", Proto: "https",
+			Port: 443, ExpirationTimeMonths: 6, MaxLinksPerDay: 2},
+		{Name: "hr", Domains: []string{"hr.example.com"}, Namespace: "hr", Proto: "http", Port: 80,
+			ExpirationTimeMonths: 1},
+	}
+	return &conf
+}
+
+// create a short url for the host through the create handler, returns the response
+func postTenantShortlink(handler http.Handler, host string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://"+host+"/shortlink", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestTenants(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	conf := tenantsConf()
+	r := mux.NewRouter()
+	r.HandleFunc("/shortlink", CreateHandler(linkStore, conf))
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, conf, testAnalyzer, clickhelper.NewRecorder(linkStore, conf)))
+
+	// the same token in the namespace of each tenant, with its short domain
+	expected := map[string]string{
+		"myhost.com":     "http://myhost.com/same01",
+		"ex.am":          "https://ex.am/same01",
+		"hr.example.com": "http://hr.example.com/same01",
+	}
+	for host, shortUrl := range expected {
+		w := postTenantShortlink(r, host, `{"url": "`+target.URL+`/`+host+`", "token": "same01"}`)
+		if w.Code != 201 {
+			t.Fatal("Wrong status code for", host, "got", w.Code)
+		}
+		var body create_response_body
+		json.NewDecoder(w.Body).Decode(&body)
+		if body.Url != shortUrl {
+			t.Error("Wrong short url for", host, "got", body.Url)
+		}
+	}
+
+	// the token is resolved in the namespace of the tenant of the host
+	for host, url := range map[string]string{
+		"myhost.com":     target.URL + "/myhost.com",
+		"EX.am:8080":     target.URL + "/ex.am",
+		"unknown.com":    target.URL + "/myhost.com",
+		"hr.example.com": target.URL + "/hr.example.com",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+host+"/same01", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 301 || w.Header().Get("Location") != url {
+			t.Error("Wrong redirection for", host, "got", w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// the clicks are recorded in the namespace of the tenant
+	link, _ := store.WithNamespace(linkStore, "marketing@ex.am").GetLink("same01")
+	if link == nil || link.Count != 1 {
+		t.Error("Click not recorded in the namespace: got", link)
+	}
+
+	// the default expiration of the tenant
+	link, _ = store.WithNamespace(linkStore, "hr").GetLink("same01")
+	if link == nil || link.Expiration > time.Now().AddDate(0, 1, 1).Unix() {
+		t.Error("Wrong expiration for the tenant: got", link)
+	}
+}
+
+// reservingStore is a store whose reservations fail
+type reservingStore struct {
+	*store.MemoryStore
+}
+
+func (s *reservingStore) Reserve(token string, link store.Link) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestTenantQuota(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	// the links which could not be created are not counted in the quota
+	failing := http.HandlerFunc(CreateHandler(&reservingStore{linkStore}, tenantsConf()))
+	for i := 0; i < 3; i++ {
+		if w := postTenantShortlink(failing, "go.example.com", `{"url": "`+target.URL+`"}`); w.Code != 500 {
+			t.Fatal("Wrong status code with the reservations failing: got", w.Code)
+		}
+	}
+
+	handler := http.HandlerFunc(CreateHandler(linkStore, tenantsConf()))
+	for i := 0; i < 2; i++ {
+		if w := postTenantShortlink(handler, "go.example.com", `{"url": "`+target.URL+`"}`); w.Code != 201 {
+			t.Fatal("Wrong status code within the quota: got", w.Code)
+		}
+	}
+
+	w := postTenantShortlink(handler, "ex.am", `{"url": "`+target.URL+`"}`)
+	if w.Code != 429 {
+		t.Error("Quota of the tenant not enforced: got", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("No Retry-After with the 429")
+	}
+
+	// the refused links are not counted either
+	if w := postTenantShortlink(failing, "go.example.com", `{"url": "`+target.URL+`"}`); w.Code != 429 {
+		t.Error("Quota of the tenant not enforced: got", w.Code)
+	}
+	if count, _ := linkStore.IncrementCounter(quotaCounter(tenantsConf().TenantOf("ex.am"), time.Now())); count != 3 {
+		t.Error("Wrong count of the quota: got", count)
+	}
+
+	// the other tenants have their own quotas
+	if w := postTenantShortlink(handler, "hr.example.com", `{"url": "`+target.URL+`"}`); w.Code != 201 {
+		t.Error("Quota of another tenant enforced: got", w.Code)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	conf := tenantsConf()
+	conf.Domains = []string{"sh.rt"}
+	r := mux.NewRouter()
+	r.HandleFunc("/shortlink", CreateHandler(linkStore, conf))
+	r.HandleFunc("/admin/{token}", RequireOwner(linkStore, conf, AdminHandler(linkStore, conf)))
+	r.HandleFunc("/{token}", RedirectHandler(linkStore, conf, testAnalyzer, clickhelper.NewRecorder(linkStore, conf)))
+
+	// the same token on each domain, picked by the domain of the request
+	expected := map[string]string{
+		"":      "http://myhost.com/dom001",
+		"SH.RT": "http://sh.rt/dom001",
+	}
+	for domain, shortUrl := range expected {
+		w := postTenantShortlink(r, "myhost.com", `{"url": "`+target.URL+`/`+domain+`", "token": "dom001", "domain": "`+domain+`"}`)
+		if w.Code != 201 {
+			t.Fatal("Wrong status code for", domain, "got", w.Code)
+		}
+		var body create_response_body
+		json.NewDecoder(w.Body).Decode(&body)
+		if body.Url != shortUrl {
+			t.Error("Wrong short url for", domain, "got", body.Url)
+		}
+	}
+
+	// only the domains of the tenant of the host
+	if w := postTenantShortlink(r, "myhost.com", `{"url": "`+target.URL+`", "domain": "ex.am"}`); w.Code != 400 {
+		t.Error("Link created on the domain of another tenant: got", w.Code)
+	}
+
+	// the token is resolved in the namespace of the domain of the host
+	for host, url := range map[string]string{
+		"myhost.com": target.URL + "/",
+		"sh.rt":      target.URL + "/SH.RT",
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+host+"/dom001", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 301 || w.Header().Get("Location") != url {
+			t.Error("Wrong redirection for", host, "got", w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// or in the namespace of the domain parameter of the admin requests
+	for domain, code := range map[string]int{"sh.rt": 200, "ex.am": 400} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://myhost.com/admin/dom001?domain="+domain, nil)
+		r.ServeHTTP(w, req)
+		var body admin_response_body
+		json.NewDecoder(w.Body).Decode(&body)
+		if w.Code != code || (code == 200 && body.Url != target.URL+"/SH.RT") {
+			t.Error("Wrong admin response for", domain, "got", w.Code, body.Url)
+		}
+	}
+
+	// the host of the config is matched like the other domains
+	conf.Host = "MyHost.com"
+	if domain, ok := conf.DefaultTenant().LookupDomain("myhost.com"); !ok || domain != "myhost.com" {
+		t.Error("Host of the config not matched: got", domain, ok)
+	}
+}
+
+func TestTenantKeys(t *testing.T) {
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+
+	conf := tenantsConf()
+	conf.AdminSecret = "secret"
+	marketing, _ := conf.LookupTenant("marketing")
+	marketingKey, _, _ := IssueKey(linkStore, marketing, "team-a", []string{ScopeReadStats})
+	defaultKey, _, _ := IssueKey(linkStore, conf.DefaultTenant(), "team-b", []string{ScopeReadStats})
+	// a key issued before the tenants
+	linkStore.AddKey(store.APIKey{ID: "0123456789abcdef", Name: "legacy", Hash: hashSecret("legacy"), Scopes: []string{ScopeReadStats}})
+	legacyKey := "0123456789abcdef.legacy"
+
+	// an anonymous link in the namespace of each tenant
+	store.WithNamespace(linkStore, "marketing").Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: testExpiration.Unix()})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", RequireScope(linkStore, conf, ScopeReadStats, RequireOwner(linkStore, conf, AdminHandler(linkStore, conf))))
+	requests := []struct {
+		host string
+		key  string
+		code int
+	}{
+		{"go.example.com", marketingKey, 200},
+		{"myhost.com", marketingKey, 403},
+		{"myhost.com", defaultKey, 200},
+		{"go.example.com", defaultKey, 403},
+		{"myhost.com", legacyKey, 200},
+		{"go.example.com", legacyKey, 403},
+		{"go.example.com", "secret", 200},
+		{"myhost.com", "secret", 200},
+	}
+	for _, request := range requests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+request.host+"/admin/abc123", nil)
+		req.Header.Set("Authorization", "Bearer "+request.key)
+		r.ServeHTTP(w, req)
+		if w.Code != request.code {
+			t.Error("Wrong status code for", request.host, request.key, "got", w.Code)
+		}
+	}
+
+	// the owner check rejects the keys of another tenant too
+	owner := mux.NewRouter()
+	owner.HandleFunc("/admin/{token}", func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, apiKeyContextKey, &store.APIKey{ID: "0123456789abcdef", Tenant: "marketing"})
+		RequireOwner(linkStore, conf, AdminHandler(linkStore, conf))(w, r)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://myhost.com/admin/abc123", nil)
+	owner.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Error("Owner check passed with the key of another tenant: got", w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/confighelper"
+	"github.com/BenoitHanotte/shorturls/store"
+	"github.com/BenoitHanotte/shorturls/urlhelper"
+	"net/http"
+)
+
+// the structure of a request (unmarshalled from JSON)
+type update_request_body struct {
+	Url string // the new url of the short link
+}
+
+// factory to create the handler
+func UpdateHandler(linkStore store.LinkStore, conf *confighelper.Config) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// debug log
+		log.WithField("request", r).Debug("update request received")
+
+		// get the path variable to get the token
+		vars := mux.Vars(r)
+		token := vars["token"]
+
+		// the token is looked up in the namespace of the short domain of the request
+		linkStore, ok := tenantStore(w, r, linkStore, conf)
+		if !ok {
+			return
+		}
+
+		// unmarshall JSON
+		var body update_request_body
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			log.WithError(err).Error("can not unmarshall JSON body of update request, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+
+		// the new url has the same preconditions as on creation
+		if body.Url == "" || !urlhelper.IsValid(body.Url) {
+			log.Error("incorrect url in body of update request, returning 400: Bad Request")
+			w.WriteHeader(400)
+			return
+		}
+		if !urlhelper.IsReachable(body.Url, conf.ReachTimeoutMs) {
+			log.WithField("url", body.Url).Error("unreachable URL submitted, returning 400 bad request")
+			w.WriteHeader(400)
+			return
+		}
+
+		// the store keeps the previous url in the history of the link
+		err = linkStore.UpdateUrl(token, body.Url)
+		if err == store.ErrNotFound {
+			log.WithField("token", token).Info("token not found")
+			w.WriteHeader(404) // not found
+			return
+		} else if err != nil {
+			log.WithError(err).Error("error while updating the url in the store")
+			w.WriteHeader(500) // server error
+			return
+		}
+
+		w.WriteHeader(204) // no content
+
+		log.WithFields(log.Fields{
+			"url":   body.Url,
+			"token": token}).Info("short link updated")
+	}
+}
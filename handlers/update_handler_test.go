@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send an update request with the given body, returns the status code
+func updateLink(handler http.Handler, token string, body string) int {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/admin/"+token, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestUpdate(t *testing.T) {
+	// the server the short url redirects to, it must be reachable
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	linkStore := store.NewMemoryStore()
+	defer linkStore.Close()
+	linkStore.Reserve("abc123", store.Link{Url: target.URL + "/old", Expiration: testExpiration.Unix()})
+	linkStore.RecordClicks([]store.Click{{Token: "abc123", Time: time.Now()}}, nil)
+	before, _ := linkStore.GetLink("abc123")
+
+	conf := adminConf()
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/{token}", adminRoute(linkStore, conf, ScopeManage, UpdateHandler(linkStore, conf)))
+
+	if code := updateLink(r, "abc123", `{"url": "`+target.URL+`/new"}`); code != 204 {
+		t.Fatal("Wrong status code: got", code)
+	}
+
+	link, _ := linkStore.GetLink("abc123")
+	if link.Url != target.URL+"/new" {
+		t.Error("Url not updated: got", link.Url)
+	}
+	if link.Count != before.Count || link.CreationTime != before.CreationTime {
+		t.Error("Count or creation time not preserved: got", link)
+	}
+	if len(link.History) != 1 || link.History[0].Url != target.URL+"/old" {
+		t.Error("Wrong history: got", link.History)
+	}
+
+	if code := updateLink(r, "abc123", `{"url": "not an url"}`); code != 400 {
+		t.Error("Invalid url accepted: got", code)
+	}
+	if code := updateLink(r, "zzz999", `{"url": "`+target.URL+`/new"}`); code != 404 {
+		t.Error("Wrong status code for unknown token: got", code)
+	}
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPMetrics counts the requests and measures their duration, by route and status code
+type HTTPMetrics struct {
+	requests        *CounterVec
+	requestDuration *HistogramVec
+}
+
+// the metrics of the requests of the service, in the default registry
+var defaultHTTPMetrics = NewHTTPMetrics(Default)
+
+// NewHTTPMetrics creates the metrics of the requests in the registry
+func NewHTTPMetrics(registry *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: registry.NewCounterVec("shorturls_http_requests_total",
+			"The number of HTTP requests served, by route and status code.", "route", "code"),
+		requestDuration: registry.NewHistogramVec("shorturls_http_request_duration_seconds",
+			"The duration of the HTTP requests, by route and status code.", DefBuckets, "route", "code"),
+	}
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	// the status code is 200 if the handler writes the body without a status code
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Instrument counts the requests served by the handler and measures their duration
+// under the name of the route, in the default registry
+func Instrument(route string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return defaultHTTPMetrics.Instrument(route, handler)
+}
+
+// Instrument counts the requests served by the handler and measures their duration
+// under the name of the route
+func (m *HTTPMetrics) Instrument(route string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = 200
+		}
+		code := strconv.Itoa(recorder.status)
+		m.requests.Inc(route, code)
+		m.requestDuration.ObserveSince(start, route, code)
+	}
+}
@@ -0,0 +1,289 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are the upper bounds in seconds of the buckets of the latency histograms
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a family of samples written in the Prometheus text format
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics exposed together
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry of the metrics of the service, exposed by Handler
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry, eg: for the tests, so that they do not share
+// the counters of the default one
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes the metrics in the Prometheus text format, in the order of their
+// registration
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler serves the metrics of the default registry to Prometheus
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Handler serves the metrics of the registry to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// CounterVec counts events by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]*counterValue // by joined label values
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec creates a counter in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewCounterVec creates a counter with the given label names in the registry
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+	r.register(c)
+	return c
+}
+
+// Inc adds 1 to the counter of the label values, given in the order of the label names
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds the value to the counter of the label values
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: labelValues}
+		c.values[key] = v
+	}
+	v.value += value
+}
+
+// Value returns the counter of the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	// the samples are written in a stable order
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := c.values[key]
+		writeSample(w, c.name, c.labels, v.labelValues, "", "", v.value)
+	}
+}
+
+// HistogramVec counts observations, eg: durations, in buckets by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // the upper bounds, sorted
+	mutex   sync.Mutex
+	values  map[string]*histogramValue // by joined label values
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // by bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+// NewHistogramVec creates a histogram in the default registry
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// NewHistogramVec creates a histogram with the given bucket upper bounds and label
+// names in the registry
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	r.register(h)
+	return h
+}
+
+// Observe adds the value to the histogram of the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.sum += value
+	v.count++
+}
+
+// ObserveSince adds the time elapsed since start, in seconds
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns the number of observations of the label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if v, ok := h.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, v.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, v.labelValues, "le", "+Inf", float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, v.labelValues, "", "", v.sum)
+		writeSample(w, h.name+"_count", h.labels, v.labelValues, "", "", float64(v.count))
+	}
+}
+
+// counterFunc is a counter read from a function, eg: a counter kept by another package
+type counterFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewCounterFunc creates a counter read from the function in the default registry
+func NewCounterFunc(name, help string, value func() float64) {
+	Default.NewCounterFunc(name, help, value)
+}
+
+// NewCounterFunc creates a counter read from the function in the registry
+func (r *Registry) NewCounterFunc(name, help string, value func() float64) {
+	r.register(&counterFunc{name: name, help: help, value: value})
+}
+
+func (c *counterFunc) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	writeSample(w, c.name, nil, nil, "", "", c.value())
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	w.WriteString("# HELP " + name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help) + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// writeSample writes a sample line, the extra label is added if its name is not empty
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		var pairs []string
+		for i, label := range labels {
+			labelValue := ""
+			if i < len(labelValues) {
+				labelValue = labelValues[i]
+			}
+			pairs = append(pairs, label+`="`+escapeLabelValue(labelValue)+`"`)
+		}
+		if extraLabel != "" {
+			pairs = append(pairs, extraLabel+`="`+extraValue+`"`)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
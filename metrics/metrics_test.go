@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"github.com/BenoitHanotte/shorturls/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_requests_total", "The requests.", "route", "code")
+	counter.Inc("redirect", "301")
+	counter.Inc("redirect", "301")
+	counter.Inc("create", "201")
+	counter.Inc(`a"b`, "500")
+	histogram := r.NewHistogramVec("test_duration_seconds", "The durations.", []float64{1, 0.1}, "route")
+	histogram.Observe(0.05, "redirect")
+	histogram.Observe(0.5, "redirect")
+	histogram.Observe(5, "redirect")
+	r.NewCounterFunc("test_dropped_total", "The drops.", func() float64 { return 3 })
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_requests_total The requests.
+# TYPE test_requests_total counter
+test_requests_total{route="a\"b",code="500"} 1
+test_requests_total{route="create",code="201"} 1
+test_requests_total{route="redirect",code="301"} 2
+# HELP test_duration_seconds The durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="redirect",le="0.1"} 1
+test_duration_seconds_bucket{route="redirect",le="1"} 2
+test_duration_seconds_bucket{route="redirect",le="+Inf"} 3
+test_duration_seconds_sum{route="redirect"} 5.55
+test_duration_seconds_count{route="redirect"} 3
+# HELP test_dropped_total The drops.
+# TYPE test_dropped_total counter
+test_dropped_total 3
+`
+	if buf.String() != expected {
+		t.Error("Wrong exposition: got\n" + buf.String())
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	// a registry of the test, so that its counters start from 0 on each run
+	registry := NewRegistry()
+	httpMetrics := NewHTTPMetrics(registry)
+	handler := httpMetrics.Instrument("test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+			return
+		}
+		// no status code written: 200
+		w.Write([]byte("ok"))
+	})
+	for _, path := range []string{"/missing", "/page", "/page"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		handler(httptest.NewRecorder(), req)
+	}
+	if httpMetrics.requests.Value("test", "404") != 1 || httpMetrics.requests.Value("test", "200") != 2 {
+		t.Error("Wrong request counts: got", httpMetrics.requests.Value("test", "404"), httpMetrics.requests.Value("test", "200"))
+	}
+	if httpMetrics.requestDuration.Count("test", "200") != 2 {
+		t.Error("Durations not measured: got", httpMetrics.requestDuration.Count("test", "200"))
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	registry.Handler().ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `shorturls_http_requests_total{route="test",code="404"} 1`) {
+		t.Error("Request counts not exposed: got\n" + w.Body.String())
+	}
+}
+
+// failingStore fails the deletions
+type failingStore struct {
+	*store.MemoryStore
+}
+
+func (s failingStore) Delete(token string) error {
+	return errors.New("connection refused")
+}
+
+func TestInstrumentStore(t *testing.T) {
+	memoryStore := store.NewMemoryStore()
+	defer memoryStore.Close()
+	linkStore := InstrumentStore(NewRegistry(), failingStore{memoryStore})
+	instrumented := linkStore.(*instrumentedStore)
+	linkStore.Reserve("abc123", store.Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+
+	linkStore.Delete("abc123")
+	// a missing token is not an error
+	linkStore.GetLink("zzz999")
+	if instrumented.storageErrors.Value("delete") != 1 || instrumented.storageErrors.Value("get_link") != 0 {
+		t.Error("Wrong storage errors: got", instrumented.storageErrors.Value("delete"), instrumented.storageErrors.Value("get_link"))
+	}
+	if instrumented.storageDuration.Count("reserve") != 1 || instrumented.storageDuration.Count("get_link") != 1 {
+		t.Error("Durations not measured: got", instrumented.storageDuration.Count("reserve"), instrumented.storageDuration.Count("get_link"))
+	}
+	if link, _ := linkStore.GetLink("abc123"); link == nil {
+		t.Error("Operation not forwarded to the store")
+	}
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"github.com/BenoitHanotte/shorturls/store"
+	"time"
+)
+
+// instrumentedStore measures the duration and counts the errors of the operations
+// of a store, by operation
+type instrumentedStore struct {
+	store.LinkStore
+	storageErrors   *CounterVec
+	storageDuration *HistogramVec
+}
+
+// InstrumentStore returns the store with its operations measured in the registry
+func InstrumentStore(registry *Registry, linkStore store.LinkStore) store.LinkStore {
+	return &instrumentedStore{
+		LinkStore: linkStore,
+		storageErrors: registry.NewCounterVec("shorturls_storage_errors_total",
+			"The number of failed storage operations, by operation. A missing token is not an error.", "operation"),
+		storageDuration: registry.NewHistogramVec("shorturls_storage_operation_duration_seconds",
+			"The duration of the storage operations, by operation.", DefBuckets, "operation"),
+	}
+}
+
+// observe records an operation started at start and its error
+func (s *instrumentedStore) observe(operation string, start time.Time, err error) {
+	s.storageDuration.ObserveSince(start, operation)
+	if err != nil && err != store.ErrNotFound {
+		s.storageErrors.Inc(operation)
+	}
+}
+
+func (s *instrumentedStore) Reserve(token string, link store.Link) (bool, error) {
+	start := time.Now()
+	reserved, err := s.LinkStore.Reserve(token, link)
+	s.observe("reserve", start, err)
+	return reserved, err
+}
+
+func (s *instrumentedStore) GetRedirection(token string) (*store.Redirection, error) {
+	start := time.Now()
+	redirection, err := s.LinkStore.GetRedirection(token)
+	s.observe("get_redirection", start, err)
+	return redirection, err
+}
+
+func (s *instrumentedStore) GetStats(token string, granularity store.Granularity, from, to time.Time) ([]store.StatsBucket, error) {
+	start := time.Now()
+	buckets, err := s.LinkStore.GetStats(token, granularity, from, to)
+	s.observe("get_stats", start, err)
+	return buckets, err
+}
+
+func (s *instrumentedStore) GetBreakdown(token string, dimension store.Dimension, n int) ([]store.BreakdownEntry, error) {
+	start := time.Now()
+	entries, err := s.LinkStore.GetBreakdown(token, dimension, n)
+	s.observe("get_breakdown", start, err)
+	return entries, err
+}
+
+func (s *instrumentedStore) CountVisitors(token string) (int64, error) {
+	start := time.Now()
+	count, err := s.LinkStore.CountVisitors(token)
+	s.observe("count_visitors", start, err)
+	return count, err
+}
+
+func (s *instrumentedStore) RecordClicks(clicks []store.Click, retention map[store.Granularity]time.Duration) error {
+	start := time.Now()
+	err := s.LinkStore.RecordClicks(clicks, retention)
+	s.observe("record_clicks", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateUrl(token string, url string) error {
+	start := time.Now()
+	err := s.LinkStore.UpdateUrl(token, url)
+	s.observe("update_url", start, err)
+	return err
+}
+
+func (s *instrumentedStore) GetLink(token string) (*store.Link, error) {
+	start := time.Now()
+	link, err := s.LinkStore.GetLink(token)
+	s.observe("get_link", start, err)
+	return link, err
+}
+
+func (s *instrumentedStore) Delete(token string) error {
+	start := time.Now()
+	err := s.LinkStore.Delete(token)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *instrumentedStore) ListLinks(owner string, cursor string, n int) ([]store.OwnedLink, string, error) {
+	start := time.Now()
+	links, next, err := s.LinkStore.ListLinks(owner, cursor, n)
+	s.observe("list_links", start, err)
+	return links, next, err
+}
+
+func (s *instrumentedStore) AddKey(key store.APIKey) error {
+	start := time.Now()
+	err := s.LinkStore.AddKey(key)
+	s.observe("add_key", start, err)
+	return err
+}
+
+func (s *instrumentedStore) GetKey(id string) (*store.APIKey, error) {
+	start := time.Now()
+	key, err := s.LinkStore.GetKey(id)
+	s.observe("get_key", start, err)
+	return key, err
+}
+
+func (s *instrumentedStore) ListKeys() ([]store.APIKey, error) {
+	start := time.Now()
+	keys, err := s.LinkStore.ListKeys()
+	s.observe("list_keys", start, err)
+	return keys, err
+}
+
+func (s *instrumentedStore) RevokeKey(id string) error {
+	start := time.Now()
+	err := s.LinkStore.RevokeKey(id)
+	s.observe("revoke_key", start, err)
+	return err
+}
+
+func (s *instrumentedStore) IncrementCounter(name string, expiration time.Time) (int64, error) {
+	start := time.Now()
+	count, err := s.LinkStore.IncrementCounter(name, expiration)
+	s.observe("increment_counter", start, err)
+	return count, err
+}
+
+func (s *instrumentedStore) DecrementCounter(name string) error {
+	start := time.Now()
+	err := s.LinkStore.DecrementCounter(name)
+	s.observe("decrement_counter", start, err)
+	return err
+}
+
+func (s *instrumentedStore) TakeToken(name string, capacity int, period time.Duration) (bool, time.Duration, error) {
+	start := time.Now()
+	taken, wait, err := s.LinkStore.TakeToken(name, capacity, period)
+	s.observe("take_token", start, err)
+	return taken, wait, err
+}
+
+func (s *instrumentedStore) Ping() error {
+	start := time.Now()
+	err := s.LinkStore.Ping()
+	s.observe("ping", start, err)
+	return err
+}
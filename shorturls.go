@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/gorilla/mux"
 	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"github.com/BenoitHanotte/shorturls/clickhelper"
 	"github.com/BenoitHanotte/shorturls/confighelper"
 	"github.com/BenoitHanotte/shorturls/handlers"
+	"github.com/BenoitHanotte/shorturls/metrics"
+	"github.com/BenoitHanotte/shorturls/store"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 	"fmt"
 )
 
@@ -29,32 +38,219 @@ func main() {
 	}
 	log.Info("configuration loaded")
 
-	// create the redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     conf.RedisHost + ":" + strconv.Itoa(conf.RedisPort),
-		Password: conf.RedisPassword,  // no password set
-		DB:       int64(conf.RedisDB), // use default DB
-	})
+	// run the one-shot command instead of the server if one is given
+	if len(os.Args) > 1 {
+		if err := runCommand(conf, os.Args[1:]); err != nil {
+			log.WithError(err).Fatal("command failed")
+		}
+		return
+	}
+
+	if !conf.RequireAPIKey {
+		log.Warn("requireApiKey is false: anyone can create short urls and read their statistics without an API key")
+	}
+
+	// create the store used by the handlers to access the links
+	linkStore, err := setUpStore(conf)
+	if err != nil {
+		log.WithError(err).Fatal("could not create the store, exiting")
+		return
+	}
+	// closed on exit once the requests are drained and the clicks recorded, before the log file
+	defer func() {
+		if err := linkStore.Close(); err != nil {
+			log.WithError(err).Error("error while closing the store")
+		}
+		log.Info("store closed")
+	}()
+	log.WithField("storage", conf.Storage).Info("store created")
+	// measure the duration and count the errors of the storage operations
+	linkStore = metrics.InstrumentStore(metrics.Default, linkStore)
+
+	// the analyzer of the clicks, loading the GeoIP database and the bot patterns
+	analyzer, err := clickhelper.NewAnalyzer(conf.GeoIPFile, conf.BotPatternsFile, conf.TrustForwardedFor)
+	if err != nil {
+		log.WithError(err).Fatal("could not load the GeoIP database or the bot patterns, exiting")
+		return
+	}
+
+	// the sinks exporting the click events, closed by the recorder
+	sinks, err := clickhelper.NewSinks(conf)
+	if err != nil {
+		log.WithError(err).Fatal("could not create the click sinks, exiting")
+		return
+	}
+
+	// the recorder of the clicks, closed before the store to record the queued clicks
+	recorder := clickhelper.NewRecorder(linkStore, conf, sinks...)
+	defer func() {
+		recorder.Close()
+		log.Info("queued clicks recorded")
+	}()
+	metrics.NewCounterFunc("shorturls_clicks_dropped_total",
+		"The number of clicks dropped as the click buffer was full.",
+		func() float64 { return float64(recorder.Dropped()) })
 
 	// create the router
 	r := mux.NewRouter()
 	// Routes
 	var valueRegexp string = "[0-9a-zA-Z]{" + strconv.Itoa(conf.TokenLength) + "}"
 
-	r.HandleFunc("/{token:"+valueRegexp+"}", handlers.RedirectHandler(redisClient, conf)).
+	// before the redirections, a token could be "metrics" or "readyz"
+	r.Handle("/metrics", metrics.Handler()).
 		Methods("GET")
-	r.HandleFunc("/shortlink", handlers.CreateHandler(redisClient, conf)).
+	readiness := &handlers.Readiness{}
+	r.HandleFunc("/healthz", handlers.HealthHandler()).
+		Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", handlers.ReadyHandler(linkStore, conf, readiness)).
+		Methods("GET", "HEAD")
+	// the requests are counted and measured by route for the metrics
+	r.HandleFunc("/{token:"+valueRegexp+"}",
+		metrics.Instrument("redirect", handlers.RedirectHandler(linkStore, conf, analyzer, recorder))).
+		Methods("GET", "HEAD")
+	// the requests are limited by address before their authentication, so that the keys can
+	// not be guessed, then by API key before the checks of the urls and the accesses to the links
+	createLimiter := handlers.NewRateLimiter(linkStore, conf, "create", conf.CreateRateLimitPerIP, conf.CreateRateLimitPerKey)
+	adminLimiter := handlers.NewRateLimiter(linkStore, conf, "admin", conf.AdminRateLimitPerIP, conf.AdminRateLimitPerKey)
+	r.HandleFunc("/shortlink", metrics.Instrument("create",
+		handlers.RateLimit(createLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeCreate,
+			handlers.RateLimitKey(createLimiter, handlers.CreateHandler(linkStore, conf)))))).
 		Methods("POST").Headers("Content-Type", "application/json")
-	r.HandleFunc("/admin/{token:"+valueRegexp+"}", handlers.AdminHandler(redisClient, conf)).
+	// before the admin routes of the tokens, and only readable by the owner of the links
+	r.HandleFunc("/admin/links", metrics.Instrument("admin_links",
+		handlers.RateLimit(adminLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeReadStats,
+			handlers.RateLimitKey(adminLimiter, handlers.ListHandler(linkStore, conf)))))).
 		Methods("GET")
-
+	r.HandleFunc("/admin/{token:"+valueRegexp+"}", metrics.Instrument("admin",
+		handlers.RateLimit(adminLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeReadStats,
+			handlers.RateLimitKey(adminLimiter, handlers.RequireOwner(linkStore, conf, handlers.AdminHandler(linkStore, conf))))))).
+		Methods("GET")
+	r.HandleFunc("/admin/{token:"+valueRegexp+"}/stats",
+		metrics.Instrument("admin_stats",
+			handlers.RateLimit(adminLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeReadStats,
+				handlers.RateLimitKey(adminLimiter, handlers.RequireOwner(linkStore, conf, handlers.StatsHandler(linkStore, conf))))))).
+		Methods("GET")
+	r.HandleFunc("/admin/{token:"+valueRegexp+"}/breakdowns",
+		metrics.Instrument("admin_breakdowns",
+			handlers.RateLimit(adminLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeReadStats,
+				handlers.RateLimitKey(adminLimiter, handlers.RequireOwner(linkStore, conf, handlers.BreakdownsHandler(linkStore, conf))))))).
+		Methods("GET")
+	r.HandleFunc("/admin/{token:"+valueRegexp+"}",
+		metrics.Instrument("admin_delete",
+			handlers.RateLimit(adminLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeManage,
+				handlers.RateLimitKey(adminLimiter, handlers.RequireOwner(linkStore, conf, handlers.DeleteHandler(linkStore, conf))))))).
+		Methods("DELETE")
+	r.HandleFunc("/admin/{token:"+valueRegexp+"}",
+		metrics.Instrument("admin_update",
+			handlers.RateLimit(adminLimiter, handlers.RequireScope(linkStore, conf, handlers.ScopeManage,
+				handlers.RateLimitKey(adminLimiter, handlers.RequireOwner(linkStore, conf, handlers.UpdateHandler(linkStore, conf))))))).
+		Methods("PATCH").Headers("Content-Type", "application/json")
 	// Bind to a port and pass our router in
 	log.Info("starting the router...")
-	err = http.ListenAndServe(":"+strconv.Itoa(conf.Port), r)
-	if err != nil {
+	server := &http.Server{Addr: ":" + strconv.Itoa(conf.Port), Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// on a signal, drain the requests then return so that the deferred functions record
+	// the queued clicks and close the store and the log file
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-serverErr:
 		log.WithError(err).Fatal("could not start the router, exiting")
+	case sig := <-signals:
+		log.WithField("signal", sig).Info("signal received, shutting down")
+		shutDown(server, readiness, conf)
+	}
+}
+
+// shutDown stops the server: the readiness checks fail during the shutdown delay for
+// the load balancers to stop sending requests, then the server stops accepting
+// connections and waits for the in-flight requests until the shutdown timeout
+func shutDown(server *http.Server, readiness *handlers.Readiness, conf *confighelper.Config) {
+	readiness.ShutDown()
+	log.WithField("delayMs", conf.ShutdownDelayMs).Info("failing the readiness checks before draining the requests")
+	time.Sleep(time.Duration(conf.ShutdownDelayMs) * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeoutMs)*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		// the requests still running are cut
+		log.WithError(err).Warn("requests not drained before the shutdown timeout, closing the connections")
+		server.Close()
 		return
 	}
+	log.Info("requests drained")
+}
+
+// create the store selected by the "storage" configuration
+func setUpStore(conf *confighelper.Config) (store.LinkStore, error) {
+	switch conf.Storage {
+	case "", "redis":
+		redisClient, err := setUpRedis(conf)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewRedisStore(redisClient, conf.RedisKeyPrefix), nil
+	case "sql":
+		// the driver must be linked in the binary, see the sqldriver_*.go files
+		db, err := sql.Open(conf.SQLDriver, conf.SQLDSN)
+		if err != nil {
+			return nil, err
+		}
+		linkStore, err := store.NewSQLStore(db, conf.SQLDriver)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return linkStore, nil
+	case "file":
+		return store.NewFileStore(conf.StorageFile)
+	case "memory":
+		log.Warn("using the in-memory store, links will be lost on exit")
+		return store.NewMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown storage: " + conf.Storage)
+	}
+}
+
+// create the redis client of the "redisMode" configuration
+func setUpRedis(conf *confighelper.Config) (store.RedisClient, error) {
+	switch conf.RedisMode {
+	case "", "standalone":
+		return redis.NewClient(&redis.Options{
+			Addr:     conf.RedisHost + ":" + strconv.Itoa(conf.RedisPort),
+			Password: conf.RedisPassword,  // no password set
+			DB:       int64(conf.RedisDB), // use default DB
+		}), nil
+	case "sentinel":
+		// the sentinels give the address of the current master, and of the new one on failover
+		if conf.RedisMasterName == "" || len(conf.RedisSentinelAddrs) == 0 {
+			return nil, errors.New("redisMasterName and redisSentinelAddrs are required in sentinel mode")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    conf.RedisMasterName,
+			SentinelAddrs: conf.RedisSentinelAddrs,
+			Password:      conf.RedisPassword,
+			DB:            int64(conf.RedisDB),
+		}), nil
+	case "cluster":
+		// the seed nodes are used to discover the cluster, only the DB 0 exists in a cluster
+		if len(conf.RedisClusterAddrs) == 0 {
+			return nil, errors.New("redisClusterAddrs is required in cluster mode")
+		}
+		if conf.RedisDB != 0 {
+			log.WithField("redisDB", conf.RedisDB).Warn("redisDB is ignored in cluster mode")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    conf.RedisClusterAddrs,
+			Password: conf.RedisPassword,
+		}), nil
+	default:
+		return nil, errors.New("unknown redis mode: " + conf.RedisMode)
+	}
 }
 
 // set up the logrus logger
@@ -84,7 +280,7 @@ func setUpLog() func() {
 		// consider any other value as a filepath
 		f, err := os.Create(logFile)
 		if err!=nil {
-			fmt.Errorf("Unable to open log file: %s", err.Error())
+			fmt.Fprintf(os.Stderr, "Unable to open log file: %s\n", err.Error())
 			os.Exit(1)
 		}
 		log.SetOutput(f)
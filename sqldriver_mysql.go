@@ -0,0 +1,7 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// link the mysql driver used by the sql storage, build with: go build -tags mysql
+import _ "github.com/go-sql-driver/mysql"
@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// link the postgres driver used by the sql storage, build with: go build -tags postgres
+import _ "github.com/lib/pq"
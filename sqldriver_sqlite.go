@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// link the sqlite driver used by the sql storage, build with: go build -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"unicode/utf8"
+)
+
+// Dimension is a property of the clicks by which they are counted
+type Dimension string
+
+const (
+	Referrer Dimension = "referrer" // the host of the referring page
+	Browser  Dimension = "browser"  // the browser family parsed from the user agent
+	OS       Dimension = "os"       // the operating system parsed from the user agent
+	Device   Dimension = "device"   // the device class parsed from the user agent
+	Country  Dimension = "country"  // the country of the client IP
+)
+
+// Dimensions lists the dimensions of the breakdowns of the clicks
+var Dimensions = []Dimension{Referrer, Browser, OS, Device, Country}
+
+// ErrInvalidDimension is returned for a dimension which is not in Dimensions
+var ErrInvalidDimension = errors.New("invalid dimension")
+
+// ParseDimension returns the dimension of the given name
+func ParseDimension(name string) (Dimension, error) {
+	for _, d := range Dimensions {
+		if string(d) == name {
+			return d, nil
+		}
+	}
+	return "", ErrInvalidDimension
+}
+
+// the maximum length in bytes of the values of the breakdowns, the longer values are truncated
+const maxBreakdownValueLength = 128
+
+// breakdownValue returns the value to store for a value of a breakdown. The value is
+// truncated at the start of a character, so that a multi-byte character is not split
+func breakdownValue(value string) string {
+	if len(value) <= maxBreakdownValueLength {
+		return value
+	}
+	end := maxBreakdownValueLength
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
+
+// BreakdownEntry holds the number of clicks for a value of a dimension
+type BreakdownEntry struct {
+	Value string
+	Count int64
+}
+
+// topEntries returns the n values with the most clicks, by decreasing count
+func topEntries(counts map[string]int64, n int) []BreakdownEntry {
+	entries := make([]BreakdownEntry, 0, len(counts))
+	for value, count := range counts {
+		entries = append(entries, BreakdownEntry{Value: value, Count: count})
+	}
+	sortEntries(entries)
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// sortEntries sorts the entries by decreasing count, then by value for a stable order
+func sortEntries(entries []BreakdownEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Value < entries[j].Value
+	})
+}
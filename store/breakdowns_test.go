@@ -0,0 +1,30 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBreakdownValue(t *testing.T) {
+	var values = []struct {
+		value    string
+		expected string
+	}{
+		{"Firefox", "Firefox"},
+		{strings.Repeat("a", 128), strings.Repeat("a", 128)},
+		{strings.Repeat("a", 130), strings.Repeat("a", 128)},
+		// the 2 bytes of é would be split at 128 bytes
+		{strings.Repeat("a", 127) + "éa", strings.Repeat("a", 127)},
+		{strings.Repeat("a", 126) + "éa", strings.Repeat("a", 126) + "é"},
+		// the 4 bytes of 😀 would be split at 128 bytes
+		{strings.Repeat("a", 125) + "😀", strings.Repeat("a", 125)},
+	}
+
+	for _, v := range values {
+		got := breakdownValue(v.value)
+		if got != v.expected || !utf8.ValidString(got) {
+			t.Error("For", v.value, "got", got, "expected", v.expected)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"math"
+	"time"
+)
+
+// TokenBucket is a bucket holding up to a capacity of tokens, refilled continuously with
+// the capacity per period. The in-memory rate limits and the stores share it
+type TokenBucket struct {
+	Tokens   float64   // the tokens left, a fraction of token is refilled between the uses
+	LastUsed time.Time // the time of the last refill
+}
+
+// NewTokenBucket returns a full bucket
+func NewTokenBucket(capacity int, now time.Time) *TokenBucket {
+	return &TokenBucket{Tokens: float64(capacity), LastUsed: now}
+}
+
+// Take refills the bucket for the time elapsed since its last use and takes a token. If
+// the bucket holds less than a token, false is returned with the time until it holds one
+func (b *TokenBucket) Take(capacity int, period time.Duration, now time.Time) (bool, time.Duration) {
+	rate := float64(capacity) / float64(period) // the tokens refilled per nanosecond
+	if elapsed := now.Sub(b.LastUsed); elapsed > 0 {
+		b.Tokens = math.Min(float64(capacity), b.Tokens+float64(elapsed)*rate)
+		b.LastUsed = now
+	}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	return false, time.Duration(math.Ceil((1 - b.Tokens) / rate))
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"time"
+)
+
+// Click is a redirection to record in the counters of a link
+type Click struct {
+	Token       string
+	Time        time.Time
+	Bot         bool                 // only counted in the bot count of the link
+	Breakdowns  map[Dimension]string // the value of each dimension, for the humans
+	Fingerprint string               // the unique visitor, for the humans
+}
+
+// clickCounter holds the increments of the stores recording the clicks one by one,
+// they are only called by their RecordClicks
+type clickCounter interface {
+	// incrementCount increments the number of redirections of the token and returns
+	// the new count
+	incrementCount(token string) (int64, error)
+
+	// incrementBotCount increments the number of redirections of the token served to
+	// bots and returns the new count
+	incrementBotCount(token string) (int64, error)
+
+	// incrementStats increments the click counter of the bucket of the given granularity
+	// containing the time. The buckets older than the retention are removed
+	incrementStats(token string, granularity Granularity, t time.Time, retention time.Duration) error
+
+	// incrementBreakdowns increments the click counters of the given value of each dimension
+	incrementBreakdowns(token string, values map[Dimension]string) error
+
+	// addVisitor adds the fingerprint of a visitor to the unique visitors of the link
+	addVisitor(token string, fingerprint string) error
+}
+
+// recordClicks records the clicks one by one with the increments of the store, for
+// the stores without batches. The increments return ErrNotFound if the token does not
+// exist: the clicks of the missing links are ignored, the first error is returned once
+// all the clicks are recorded
+func recordClicks(s clickCounter, clicks []Click, retention map[Granularity]time.Duration) error {
+	var firstErr error
+	for _, click := range clicks {
+		if err := recordClick(s, click, retention); err != nil && err != ErrNotFound && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func recordClick(s clickCounter, click Click, retention map[Granularity]time.Duration) error {
+	if click.Bot {
+		_, err := s.incrementBotCount(click.Token)
+		return err
+	}
+	if _, err := s.incrementCount(click.Token); err != nil {
+		return err
+	}
+	for _, granularity := range Granularities {
+		if err := s.incrementStats(click.Token, granularity, click.Time, retention[granularity]); err != nil {
+			return err
+		}
+	}
+	if len(click.Breakdowns) > 0 {
+		if err := s.incrementBreakdowns(click.Token, click.Breakdowns); err != nil {
+			return err
+		}
+	}
+	if click.Fingerprint != "" {
+		return s.addVisitor(click.Token, click.Fingerprint)
+	}
+	return nil
+}
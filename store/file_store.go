@@ -0,0 +1,375 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the interval between two removals of the expired links from the file
+const fileSweepInterval = time.Minute
+
+// the journal is compacted when it contains more than compactionRatio records per link
+const compactionRatio = 2
+
+// FileStore keeps the links in memory and persists them in a single file, for the
+// deployments without Redis. Each change of a link is appended to the file as a JSON
+// line holding the new state of the link, synced before the change is acknowledged;
+// the changes made by a batch of clicks are appended as a single line. The file is
+// read back when the store is opened and compacted by the sweeper removing the expired
+// links. The counters of the quotas and the buckets of the rate limits are not persisted
+type FileStore struct {
+	*MemoryStore
+	path    string
+	file    *os.File
+	records int        // the number of records in the file
+	size    int64      // the size of the file up to the end of its last complete record
+	batch   *fileBatch // the changes of the batch of clicks being recorded, nil out of the batches
+}
+
+// a line of the file: the state of a link after a change, the new value of
+// a counter of its statistics, the state of an API key, or the records of the
+// changes made by a batch of clicks
+type fileRecord struct {
+	Token      string        `json:"token"`
+	Link       *Link         `json:"link,omitempty"`       // nil if the link was removed
+	Expiration int64         `json:"expiration,omitempty"` // 0 if the link never expires
+	Deleted    bool          `json:"deleted,omitempty"`    // the link is a tombstone
+	Stats      *statsCounter `json:"stats,omitempty"`      // set for the records of the statistics
+	Key        *APIKey       `json:"key,omitempty"`        // set for the records of the API keys
+	Clicks     []fileRecord  `json:"clicks,omitempty"`     // set for the records of the batches of clicks
+}
+
+// fileBatch holds the last state of the links and counters changed by a batch of clicks
+type fileBatch struct {
+	records []fileRecord
+	index   map[string]int // the index of the record of a link or counter
+}
+
+// NewFileStore opens the store persisted in the file at path, the file is created
+// if it does not exist. Close must be called to stop the sweeper and close the file
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: newMemoryStore(),
+		path:        path,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// rewrite the file to start from a compacted journal
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	s.persist = s.append
+	s.persistStats = s.appendStats
+	s.persistKey = s.appendKey
+	s.persistClicks = s.appendClicks
+	go s.sweep(fileSweepInterval, func() {
+		// compact if the journal is too large compared to the number of links, counters and keys
+		if s.records > compactionRatio*s.liveRecords()+compactionRatio {
+			if err := s.compact(); err != nil {
+				log.WithError(err).Error("could not compact the store file")
+			}
+		}
+	})
+	return s, nil
+}
+
+// load reads the records of the file to rebuild the links in memory
+func (s *FileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// the last record was not fully written (crash while writing), ignore it
+				log.WithField("file", s.path).Warn("incomplete last record in the store file, ignored")
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var record fileRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return errors.New("corrupted store file " + s.path + ": " + err.Error())
+		}
+		s.apply(record, now)
+	}
+}
+
+// apply loads the change of a record of the file
+func (s *FileStore) apply(record fileRecord, now time.Time) {
+	if record.Clicks != nil {
+		for _, change := range record.Clicks {
+			s.apply(change, now)
+		}
+		return
+	}
+	if record.Key != nil {
+		s.keys[record.Key.ID] = record.Key
+		return
+	}
+	if record.Stats != nil {
+		// the statistics follow the record of their link
+		if l, ok := s.links[record.Token]; ok && !l.deleted {
+			s.setCounter(record.Token, record.Stats)
+		}
+		return
+	}
+	l := record.toMemoryLink()
+	if l == nil || l.expired(now) || l.deleted {
+		delete(s.stats, record.Token)
+	}
+	if l == nil || l.expired(now) {
+		delete(s.links, record.Token)
+	} else {
+		s.links[record.Token] = l
+	}
+}
+
+// setCounter sets the value of a counter of the statistics of the link
+func (s *FileStore) setCounter(token string, counter *statsCounter) {
+	stats := s.statsOf(token)
+	if counter.Rank > 0 {
+		if stats.visitors == nil {
+			stats.visitors = newHyperLogLog()
+		}
+		stats.visitors.set(counter.Register, counter.Rank)
+	} else if counter.Dimension != "" {
+		stats.breakdownOf(counter.Dimension)[counter.Value] = counter.Count
+	} else {
+		stats.bucketsOf(counter.Granularity)[counter.Start] = counter.Count
+	}
+}
+
+// append writes the new state of a link at the end of the file, synced so that the
+// link is not lost once the change is acknowledged
+func (s *FileStore) append(token string, l *memoryLink) error {
+	if s.batch != nil {
+		s.batch.add("link\xff"+token, newFileRecord(token, l))
+		return nil
+	}
+	return s.write(newFileRecord(token, l), true)
+}
+
+// appendStats writes the new value of a counter at the end of the file
+func (s *FileStore) appendStats(token string, counter statsCounter) error {
+	if s.batch != nil {
+		s.batch.add(strings.Join([]string{"stats", token, string(counter.Granularity), strconv.FormatInt(counter.Start, 10),
+			string(counter.Dimension), counter.Value, strconv.Itoa(counter.Register)}, "\xff"),
+			fileRecord{Token: token, Stats: &counter})
+		return nil
+	}
+	return s.write(fileRecord{Token: token, Stats: &counter}, false)
+}
+
+// appendKey writes the new state of an API key at the end of the file, synced
+func (s *FileStore) appendKey(key *APIKey) error {
+	return s.write(fileRecord{Key: key}, true)
+}
+
+// appendClicks records a batch of clicks and writes the changes of the links and
+// counters as a single record at the end of the file. The record is not synced: a
+// crash loses at most the clicks of the last batches
+func (s *FileStore) appendClicks(record func() error) error {
+	s.batch = &fileBatch{index: make(map[string]int)}
+	err := record()
+	batch := s.batch
+	s.batch = nil
+
+	if len(batch.records) == 0 {
+		return err
+	}
+	if writeErr := s.write(fileRecord{Clicks: batch.records}, false); err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// write appends the record to the file, and syncs the file if required
+func (s *FileStore) write(record fileRecord, sync bool) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(line, '\n')); err != nil {
+		if truncateErr := s.truncate(); truncateErr != nil {
+			log.WithError(truncateErr).WithField("file", s.path).Error("could not remove a partial record from the store file")
+		}
+		return err
+	}
+	s.size += int64(len(line)) + 1
+	if record.Clicks != nil {
+		s.records += len(record.Clicks)
+	} else {
+		s.records++
+	}
+	if sync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// truncate removes the partial line left by a failed write, so that the next records
+// are not appended to it and the file can still be loaded
+func (s *FileStore) truncate() error {
+	return s.file.Truncate(s.size)
+}
+
+// add keeps the record as the last state of the link or counter of the key
+func (b *fileBatch) add(key string, record fileRecord) {
+	if i, ok := b.index[key]; ok {
+		b.records[i] = record
+		return
+	}
+	b.index[key] = len(b.records)
+	b.records = append(b.records, record)
+}
+
+// compact rewrites the file with the API keys and only the links that have not expired.
+// The new file is written next to the old one and renamed so that the file is never
+// left incomplete
+func (s *FileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	now := time.Now()
+	records := 0
+	for _, key := range s.keys {
+		if err = encoder.Encode(fileRecord{Key: key}); err != nil {
+			break
+		}
+		records++
+	}
+	for token, l := range s.links {
+		if err != nil {
+			// the API keys could not be written
+			break
+		}
+		if l.expired(now) {
+			continue
+		}
+		if err = encoder.Encode(newFileRecord(token, l)); err != nil {
+			break
+		}
+		records++
+		var n int
+		if n, err = encodeStats(encoder, token, s.stats[token]); err != nil {
+			break
+		}
+		records += n
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// reopen the new file to append the next records
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	s.records = records
+	s.size = info.Size()
+	return nil
+}
+
+// liveRecords returns the number of records of a compacted journal, the mutex
+// must be held by the caller
+func (s *FileStore) liveRecords() int {
+	records := len(s.links) + len(s.keys)
+	for _, stats := range s.stats {
+		records += len(stats.counters())
+	}
+	return records
+}
+
+// Close stops the sweeper and closes the file
+func (s *FileStore) Close() error {
+	s.MemoryStore.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// encodeStats writes a record for each counter of the statistics of the link and
+// returns the number of records
+func encodeStats(encoder *json.Encoder, token string, stats *memoryStats) (int, error) {
+	var counters []statsCounter
+	if stats != nil {
+		counters = stats.counters()
+	}
+	for i := range counters {
+		if err := encoder.Encode(fileRecord{Token: token, Stats: &counters[i]}); err != nil {
+			return i, err
+		}
+	}
+	return len(counters), nil
+}
+
+func newFileRecord(token string, l *memoryLink) fileRecord {
+	if l == nil {
+		return fileRecord{Token: token}
+	}
+	link := l.link
+	return fileRecord{
+		Token:      token,
+		Link:       &link,
+		Expiration: UnixOrZero(l.expiration),
+		Deleted:    l.deleted,
+	}
+}
+
+func (r *fileRecord) toMemoryLink() *memoryLink {
+	if r.Link == nil {
+		return nil
+	}
+	return &memoryLink{
+		link:       *r.Link,
+		expiration: expirationTime(r.Expiration),
+		deleted:    r.Deleted,
+	}
+}
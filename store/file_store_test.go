@@ -0,0 +1,198 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// create a temporary directory for the store file, to remove at the end of the test
+func tempStorePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "shorturls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "shorturls.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestFileStorePersistence(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Could not open the store:", err)
+	}
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.Reserve("def456", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.Reserve("expire", Link{Url: "http://example.com/", Expiration: time.Now().Add(-time.Second).Unix()})
+	s.Reserve("perm", Link{Url: "http://example.com/"})
+	retention := map[Granularity]time.Duration{Hourly: time.Hour, Daily: time.Hour}
+	s.RecordClicks([]Click{
+		{Token: "abc123", Time: time.Now(), Breakdowns: map[Dimension]string{Country: "FR"}, Fingerprint: "visitor1"},
+		{Token: "abc123", Time: time.Now(), Fingerprint: "visitor2"},
+	}, retention)
+	s.RecordClicks([]Click{{Token: "abc123", Time: time.Now(), Bot: true}, {Token: "def456", Time: time.Now()}}, retention)
+	s.UpdateUrl("abc123", "http://example.org/")
+	s.Delete("def456")
+	s.Close()
+
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal("Could not reopen the store:", err)
+	}
+	defer s.Close()
+
+	link, err := s.GetLink("abc123")
+	if err != nil || link.Url != "http://example.org/" || link.Count != 2 {
+		t.Error("Wrong link after reopening: got", link, err)
+	} else if len(link.History) != 1 || link.History[0].Url != "http://google.com/" {
+		t.Error("Wrong history after reopening: got", link.History)
+	}
+	if buckets, err := s.GetStats("abc123", Hourly, time.Now().Add(-time.Hour), time.Now()); err != nil ||
+		len(buckets) != 1 || buckets[0].Count != 2 {
+		t.Error("Wrong stats after reopening: got", buckets, err)
+	}
+	if entries, err := s.GetBreakdown("abc123", Country, 10); err != nil || len(entries) != 1 || entries[0].Count != 1 {
+		t.Error("Wrong breakdown after reopening: got", entries, err)
+	}
+	if count, err := s.CountVisitors("abc123"); count != 2 || err != nil {
+		t.Error("Wrong unique visitors after reopening: got", count, err)
+	}
+	if _, err := s.GetLink("def456"); err != ErrNotFound {
+		t.Error("Deleted link found after reopening, error:", err)
+	}
+	if ok, _ := s.Reserve("def456", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()}); ok {
+		t.Error("Tombstone lost after reopening")
+	}
+	if _, ok := s.stats["def456"]; ok {
+		t.Error("Stats of a deleted link loaded")
+	}
+	if _, err := s.GetLink("expire"); err != ErrNotFound {
+		t.Error("Expired link found after reopening, error:", err)
+	}
+	if link, err := s.GetLink("perm"); err != nil || link.Expiration != 0 {
+		t.Error("Wrong permanent link after reopening: got", link, err)
+	}
+	if ok, _ := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()}); ok {
+		t.Error("Reserved a token used before reopening")
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, _ := NewFileStore(path)
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	for i := 0; i < 10; i++ {
+		s.RecordClicks([]Click{{Token: "abc123", Time: time.Now(), Bot: true}}, nil)
+	}
+	s.Close()
+
+	// reopening compacts the file to a single record
+	s, _ = NewFileStore(path)
+	s.Close()
+	content, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(content), "\n"); lines != 1 {
+		t.Error("File not compacted: got", lines, "records")
+	}
+}
+
+func TestFileStoreClicksRecord(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, _ := NewFileStore(path)
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.Reserve("def456", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	before, _ := ioutil.ReadFile(path)
+
+	// the changes of a batch of clicks are written as a single record
+	clicks := make([]Click, 100)
+	for i := range clicks {
+		clicks[i] = Click{Token: []string{"abc123", "def456", "zzz999"}[i%3], Time: time.Now(),
+			Breakdowns: map[Dimension]string{Referrer: "t.co"}, Fingerprint: "visitor" + strconv.Itoa(i)}
+	}
+	if err := s.RecordClicks(clicks, map[Granularity]time.Duration{Hourly: time.Hour, Daily: time.Hour}); err != nil {
+		t.Fatal("Could not record the clicks:", err)
+	}
+	s.Close()
+	after, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(after[len(before):]), "\n"); lines != 1 {
+		t.Error("Wrong number of records for the batch: got", lines)
+	}
+
+	s, _ = NewFileStore(path)
+	defer s.Close()
+	if link, _ := s.GetLink("def456"); link == nil || link.Count != 33 {
+		t.Error("Wrong count after reopening: got", link)
+	}
+	if entries, _ := s.GetBreakdown("abc123", Referrer, 10); len(entries) != 1 || entries[0].Count != 34 {
+		t.Error("Wrong breakdown after reopening: got", entries)
+	}
+	if count, _ := s.CountVisitors("abc123"); count < 32 || count > 36 {
+		t.Error("Wrong visitors after reopening: got", count)
+	}
+}
+
+func TestFileStoreIncompleteRecord(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, _ := NewFileStore(path)
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.Close()
+
+	// simulate a crash while writing the last record
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"token":"def456","link":{"url":"http://exa`)
+	f.Close()
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Could not open a store with an incomplete record:", err)
+	}
+	defer s.Close()
+	if _, err := s.GetLink("abc123"); err != nil {
+		t.Error("Link lost:", err)
+	}
+	if _, err := s.GetLink("def456"); err != ErrNotFound {
+		t.Error("Incomplete link loaded, error:", err)
+	}
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, _ := NewFileStore(path)
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+
+	// simulate a write failing after a part of the record, the next records must
+	// not be appended to the partial line
+	s.file.WriteString(`{"token":"zzz999","link":{"url":"http://exa`)
+	if err := s.truncate(); err != nil {
+		t.Fatal("Could not remove the partial record:", err)
+	}
+	s.Reserve("def456", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.Close()
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Could not reopen the store after a failed write:", err)
+	}
+	defer s.Close()
+	for _, token := range []string{"abc123", "def456"} {
+		if _, err := s.GetLink(token); err != nil {
+			t.Error("Link lost:", token, err)
+		}
+	}
+	if _, err := s.GetLink("zzz999"); err != ErrNotFound {
+		t.Error("Partial link loaded, error:", err)
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// the precision of the sketches: 2^12 registers, for a standard error of 1.6%
+const hllPrecision = 12
+const hllRegisters = 1 << hllPrecision
+
+// hyperLogLog estimates the number of distinct fingerprints added to it, the sketch
+// used by the stores without a native HyperLogLog (the Redis store uses PFADD).
+// A register is only changed to a higher rank, so the changes can be persisted as
+// (register, rank) pairs and replayed in any order
+type hyperLogLog []uint8
+
+func newHyperLogLog() hyperLogLog {
+	return make(hyperLogLog, hllRegisters)
+}
+
+// hllPosition returns the register of the fingerprint and its rank in the register:
+// the position of the first 1 bit of the rest of its hash
+func hllPosition(fingerprint string) (int, uint8) {
+	sum := sha1.Sum([]byte(fingerprint))
+	hash := binary.BigEndian.Uint64(sum[:8])
+	register := int(hash >> (64 - hllPrecision))
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	return register, rank
+}
+
+// add adds the fingerprint and returns the register and its rank if it changed
+func (h hyperLogLog) add(fingerprint string) (int, uint8, bool) {
+	register, rank := hllPosition(fingerprint)
+	if !h.set(register, rank) {
+		return 0, 0, false
+	}
+	return register, rank, true
+}
+
+// set raises the rank of the register, it returns false if it was not lower
+func (h hyperLogLog) set(register int, rank uint8) bool {
+	if register < 0 || register >= len(h) || h[register] >= rank {
+		return false
+	}
+	h[register] = rank
+	return true
+}
+
+// count returns the estimated number of distinct fingerprints
+func (h hyperLogLog) count() int64 {
+	m := float64(len(h))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// small range correction: linear counting
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
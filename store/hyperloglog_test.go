@@ -0,0 +1,46 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	h := newHyperLogLog()
+	if count := h.count(); count != 0 {
+		t.Error("Wrong count of an empty sketch: got", count)
+	}
+
+	for _, n := range []int{10, 1000, 50000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.add("visitor" + strconv.Itoa(i))
+			// the visitors coming back are not counted again
+			if _, _, changed := h.add("visitor" + strconv.Itoa(i)); changed {
+				t.Fatal("Sketch changed by a known visitor")
+			}
+		}
+		// 5% is more than 3 standard errors
+		if count := h.count(); count < int64(float64(n)*0.95) || count > int64(float64(n)*1.05) {
+			t.Error("Wrong estimate for", n, "visitors: got", count)
+		}
+	}
+}
+
+func TestHyperLogLogReplay(t *testing.T) {
+	// the sketch rebuilt from the changes of the registers, in any order, is the same
+	h := newHyperLogLog()
+	var changes [][2]int
+	for i := 0; i < 5000; i++ {
+		if register, rank, changed := h.add("visitor" + strconv.Itoa(i)); changed {
+			changes = append(changes, [2]int{register, int(rank)})
+		}
+	}
+	replayed := newHyperLogLog()
+	for i := len(changes) - 1; i >= 0; i-- {
+		replayed.set(changes[i][0], uint8(changes[i][1]))
+	}
+	if replayed.count() != h.count() {
+		t.Error("Wrong replayed sketch: got", replayed.count(), "expected", h.count())
+	}
+}
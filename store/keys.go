@@ -0,0 +1,59 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrKeyExists is returned when a key is added with the ID of an existing key
+var ErrKeyExists = errors.New("API key already exists")
+
+// APIKey holds what is stored for a key of the API. The secret of the key is never
+// stored, only its hash
+type APIKey struct {
+	ID           string   `json:"id"`           // the public part of the key, used to find it
+	Name         string   `json:"name"`         // describes who the key was issued to
+	Tenant       string   `json:"tenant"`       // the name of the tenant of the key, empty for the default tenant
+	Hash         string   `json:"hash"`         // the hash of the secret part of the key
+	Scopes       []string `json:"scopes"`       // the operations allowed with the key
+	CreationTime int64    `json:"creationTime"` // the creation time, as a unix timestamp in seconds
+	RevokedTime  int64    `json:"revokedTime"`  // the revocation time, 0 if the key is not revoked
+}
+
+// HasScope returns true if the key allows the operations of the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked returns true if the key can not be used anymore
+func (k *APIKey) Revoked() bool {
+	return k.RevokedTime != 0
+}
+
+// sortKeys sorts the keys by creation time then ID
+func sortKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreationTime != keys[j].CreationTime {
+			return keys[i].CreationTime < keys[j].CreationTime
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
+
+// the scopes are stored joined by commas by the redis and SQL stores
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, ",")
+}
+
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return nil
+	}
+	return strings.Split(scopes, ",")
+}
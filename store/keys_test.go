@@ -0,0 +1,87 @@
+package store
+
+import (
+	"testing"
+)
+
+// testKeys checks the management of the API keys of a store
+func testKeys(t *testing.T, s LinkStore) {
+	if keys, err := s.ListKeys(); err != nil || len(keys) != 0 {
+		t.Error("Keys in an empty store: got", keys, err)
+	}
+	if _, err := s.GetKey("0123abcd"); err != ErrNotFound {
+		t.Error("Missing key found, error:", err)
+	}
+
+	s.AddKey(APIKey{ID: "0123abcd", Name: "team-a", Tenant: "marketing", Hash: "hash-a", Scopes: []string{"create", "read-stats"}, CreationTime: 1000})
+	s.AddKey(APIKey{ID: "4567efgh", Name: "team-b", Hash: "hash-b", Scopes: []string{"manage"}, CreationTime: 900})
+	if err := s.AddKey(APIKey{ID: "0123abcd", Name: "other", Hash: "hash-c", CreationTime: 1100}); err != ErrKeyExists {
+		t.Error("Key added twice, error:", err)
+	}
+
+	key, err := s.GetKey("0123abcd")
+	if err != nil || key.Name != "team-a" || key.Tenant != "marketing" || key.Hash != "hash-a" || key.CreationTime != 1000 || key.Revoked() {
+		t.Error("Wrong key: got", key, err)
+	} else if !key.HasScope("create") || !key.HasScope("read-stats") || key.HasScope("manage") {
+		t.Error("Wrong scopes: got", key.Scopes)
+	}
+
+	// by creation time
+	if keys, err := s.ListKeys(); err != nil || len(keys) != 2 || keys[0].ID != "4567efgh" || keys[1].ID != "0123abcd" {
+		t.Error("Wrong keys: got", keys, err)
+	}
+
+	if err := s.RevokeKey("0123abcd"); err != nil {
+		t.Error("Could not revoke the key:", err)
+	}
+	key, err = s.GetKey("0123abcd")
+	if err != nil || !key.Revoked() {
+		t.Error("Key not revoked: got", key, err)
+	}
+	// revoking again keeps the revocation time
+	if err := s.RevokeKey("0123abcd"); err != nil {
+		t.Error("Could not revoke the key again:", err)
+	}
+	if again, _ := s.GetKey("0123abcd"); again == nil || again.RevokedTime != key.RevokedTime {
+		t.Error("Revocation time changed: got", again)
+	}
+	if err := s.RevokeKey("missing1"); err != ErrNotFound {
+		t.Error("Revoked a missing key, error:", err)
+	}
+	// the revoked keys are still listed
+	if keys, _ := s.ListKeys(); len(keys) != 2 {
+		t.Error("Revoked key not listed: got", keys)
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	testKeys(t, s)
+}
+
+func TestFileStoreKeys(t *testing.T) {
+	path, cleanup := tempStorePath(t)
+	defer cleanup()
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("Could not open the store:", err)
+	}
+	testKeys(t, s)
+	s.Close()
+
+	// the keys are read back and kept by the compaction
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal("Could not reopen the store:", err)
+	}
+	defer s.Close()
+	if key, err := s.GetKey("0123abcd"); err != nil || key.Hash != "hash-a" || !key.Revoked() {
+		t.Error("Wrong key after reopening: got", key, err)
+	}
+	if keys, _ := s.ListKeys(); len(keys) != 2 {
+		t.Error("Wrong keys after reopening: got", keys)
+	}
+}
@@ -0,0 +1,576 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// the interval between two removals of the expired links from memory
+const memorySweepInterval = time.Minute
+
+// MemoryStore keeps the links in a map in the memory of the process.
+// Nothing is persisted, it is meant for development and tests
+type MemoryStore struct {
+	mutex sync.Mutex
+	links map[string]*memoryLink
+	stats map[string]*memoryStats // removed with the link
+	keys  map[string]*APIKey      // the API keys by ID
+	// the counters of the quotas and the token buckets of the rate limits by name, not persisted
+	counters    map[string]*memoryCounter
+	rateBuckets map[string]*memoryBucket
+	stop        chan struct{}
+	closeOnce   sync.Once
+
+	// called with the mutex held after each change of a link (nil if removed),
+	// used by the stores persisting the links
+	persist func(token string, l *memoryLink) error
+	// called with the mutex held after each change of a counter of the statistics
+	persistStats func(token string, counter statsCounter) error
+	// called with the mutex held after each change of an API key
+	persistKey func(key *APIKey) error
+	// called with the mutex held to record a batch of clicks, so that the changes of the
+	// links and counters made by the batch are persisted at once
+	persistClicks func(record func() error) error
+}
+
+// the click statistics of a link
+type memoryStats struct {
+	buckets    map[Granularity]map[int64]int64 // the counters by start of the bucket
+	breakdowns map[Dimension]map[string]int64  // the counters by value
+	visitors   hyperLogLog                     // nil until the first visitor
+}
+
+// the new value of a counter of the statistics of a link: either a bucket, a value
+// of a breakdown or a register of the unique visitors
+type statsCounter struct {
+	Granularity Granularity `json:"granularity,omitempty"`
+	Start       int64       `json:"start,omitempty"`
+	Dimension   Dimension   `json:"dimension,omitempty"`
+	Value       string      `json:"value,omitempty"`
+	Count       int64       `json:"count,omitempty"`
+	Register    int         `json:"register,omitempty"`
+	Rank        uint8       `json:"rank,omitempty"` // set for the registers, at least 1
+}
+
+// a link and the time after which it has expired
+type memoryLink struct {
+	link       Link
+	expiration time.Time // zero if the link never expires
+	deleted    bool      // a deleted link is kept as a tombstone until it expires
+}
+
+func (l *memoryLink) expired(now time.Time) bool {
+	return !l.expiration.IsZero() && !l.expiration.After(now)
+}
+
+// a counter and the time after which it starts again from 0
+type memoryCounter struct {
+	count      int64
+	expiration time.Time
+}
+
+// a token bucket of the rate limits, removed once full again
+type memoryBucket struct {
+	*TokenBucket
+	expiration time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store. Close must be called to stop
+// the background removal of the expired links
+func NewMemoryStore() *MemoryStore {
+	s := newMemoryStore()
+	go s.sweep(memorySweepInterval, nil)
+	return s
+}
+
+// create the store without starting the sweeper
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		links:       make(map[string]*memoryLink),
+		stats:       make(map[string]*memoryStats),
+		keys:        make(map[string]*APIKey),
+		counters:    make(map[string]*memoryCounter),
+		rateBuckets: make(map[string]*memoryBucket),
+		stop:        make(chan struct{}),
+	}
+}
+
+func (s *MemoryStore) Reserve(token string, link Link) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// same semantics as the redis store: only set if absent, the tombstones keep the token used
+	if s.lookup(token) != nil {
+		return false, nil
+	}
+	link.CreationTime = time.Now().Unix()
+	link.Count = 0
+	link.BotCount = 0
+	link.History = nil
+	l := &memoryLink{
+		link:       link,
+		expiration: expirationTime(link.Expiration),
+	}
+	if err := s.save(token, l); err != nil {
+		// the token is not reserved if it could not be persisted
+		return false, err
+	}
+	s.links[token] = l
+	delete(s.stats, token)
+	return true, nil
+}
+
+func (s *MemoryStore) GetRedirection(token string) (*Redirection, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.get(token)
+	if l == nil {
+		return nil, ErrNotFound
+	}
+	return &Redirection{Url: l.link.Url, Status: l.link.RedirectStatus}, nil
+}
+
+// incrementCount is called by RecordClicks, the mutex must be held by the caller
+func (s *MemoryStore) incrementCount(token string) (int64, error) {
+	l := s.get(token)
+	if l == nil {
+		return 0, ErrNotFound
+	}
+	l.link.Count++
+	return l.link.Count, s.save(token, l)
+}
+
+// incrementBotCount is called by RecordClicks, the mutex must be held by the caller
+func (s *MemoryStore) incrementBotCount(token string) (int64, error) {
+	l := s.get(token)
+	if l == nil {
+		return 0, ErrNotFound
+	}
+	l.link.BotCount++
+	return l.link.BotCount, s.save(token, l)
+}
+
+func (s *MemoryStore) GetLink(token string) (*Link, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.get(token)
+	if l == nil {
+		return nil, ErrNotFound
+	}
+	// return a copy so that the caller can not modify the stored link
+	link := l.link
+	link.History = append([]Edit(nil), l.link.History...)
+	return &link, nil
+}
+
+func (s *MemoryStore) ListLinks(owner string, cursor string, n int) ([]OwnedLink, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	links := []OwnedLink{}
+	for token := range s.links {
+		if l := s.get(token); l != nil && l.link.Owner == owner && token > cursor {
+			link := l.link
+			link.History = nil
+			links = append(links, OwnedLink{Token: token, Link: link})
+		}
+	}
+	links, next := pageLinks(links, cursor, n)
+	return links, next, nil
+}
+
+// incrementStats is called by RecordClicks, the mutex must be held by the caller
+func (s *MemoryStore) incrementStats(token string, granularity Granularity, t time.Time, retention time.Duration) error {
+	if s.get(token) == nil {
+		return ErrNotFound
+	}
+	buckets := s.statsOf(token).bucketsOf(granularity)
+
+	start := granularity.BucketStart(t).Unix()
+	if _, ok := buckets[start]; !ok {
+		// new bucket: remove the ones older than the retention
+		cutoff := start - int64(retention/time.Second)
+		for previous := range buckets {
+			if previous < cutoff {
+				delete(buckets, previous)
+			}
+		}
+	}
+	buckets[start]++
+	return s.saveStats(token, statsCounter{Granularity: granularity, Start: start, Count: buckets[start]})
+}
+
+func (s *MemoryStore) GetStats(token string, granularity Granularity, from, to time.Time) ([]StatsBucket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.get(token) == nil {
+		return nil, ErrNotFound
+	}
+	return filterBuckets(s.statsOf(token).buckets[granularity], from, to), nil
+}
+
+// incrementBreakdowns is called by RecordClicks, the mutex must be held by the caller
+func (s *MemoryStore) incrementBreakdowns(token string, values map[Dimension]string) error {
+	if s.get(token) == nil {
+		return ErrNotFound
+	}
+	stats := s.statsOf(token)
+	for dimension, value := range values {
+		counts := stats.breakdownOf(dimension)
+		value = breakdownValue(value)
+		counts[value]++
+		if err := s.saveStats(token, statsCounter{Dimension: dimension, Value: value, Count: counts[value]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetBreakdown(token string, dimension Dimension, n int) ([]BreakdownEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.get(token) == nil {
+		return nil, ErrNotFound
+	}
+	return topEntries(s.statsOf(token).breakdowns[dimension], n), nil
+}
+
+// addVisitor is called by RecordClicks, the mutex must be held by the caller
+func (s *MemoryStore) addVisitor(token string, fingerprint string) error {
+	if s.get(token) == nil {
+		return ErrNotFound
+	}
+	stats := s.statsOf(token)
+	if stats.visitors == nil {
+		stats.visitors = newHyperLogLog()
+	}
+	register, rank, changed := stats.visitors.add(fingerprint)
+	if !changed {
+		// most of the visits do not change the sketch: nothing to persist
+		return nil
+	}
+	return s.saveStats(token, statsCounter{Register: register, Rank: rank})
+}
+
+func (s *MemoryStore) CountVisitors(token string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.get(token) == nil {
+		return 0, ErrNotFound
+	}
+	stats := s.statsOf(token)
+	if stats.visitors == nil {
+		return 0, nil
+	}
+	return stats.visitors.count(), nil
+}
+
+func (s *MemoryStore) RecordClicks(clicks []Click, retention map[Granularity]time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// no round-trips to save, the changes of the batch are persisted at once by the file store
+	if s.persistClicks == nil {
+		return recordClicks(s, clicks, retention)
+	}
+	return s.persistClicks(func() error {
+		return recordClicks(s, clicks, retention)
+	})
+}
+
+func (s *MemoryStore) UpdateUrl(token string, url string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.get(token)
+	if l == nil {
+		return ErrNotFound
+	}
+	// the history is copied: the slice may be shared with a link returned by GetLink
+	updated := *l
+	updated.link.History = append(append([]Edit(nil), l.link.History...),
+		Edit{Url: l.link.Url, EditTime: time.Now().Unix()})
+	updated.link.Url = url
+	if err := s.save(token, &updated); err != nil {
+		return err
+	}
+	s.links[token] = &updated
+	return nil
+}
+
+func (s *MemoryStore) Delete(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.get(token)
+	if l == nil {
+		return ErrNotFound
+	}
+	// keep a tombstone until the link expires so that the token is not re-issued
+	tombstone := &memoryLink{
+		expiration: l.expiration,
+		deleted:    true,
+	}
+	s.links[token] = tombstone
+	delete(s.stats, token)
+	return s.save(token, tombstone)
+}
+
+func (s *MemoryStore) AddKey(key APIKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.keys[key.ID]; ok {
+		return ErrKeyExists
+	}
+	key.Scopes = append([]string(nil), key.Scopes...)
+	if err := s.saveKey(&key); err != nil {
+		return err
+	}
+	s.keys[key.ID] = &key
+	return nil
+}
+
+func (s *MemoryStore) GetKey(id string) (*APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (s *MemoryStore) ListKeys() ([]APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+func (s *MemoryStore) RevokeKey(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if key.Revoked() {
+		return nil
+	}
+	revoked := *key
+	revoked.RevokedTime = time.Now().Unix()
+	if err := s.saveKey(&revoked); err != nil {
+		return err
+	}
+	s.keys[id] = &revoked
+	return nil
+}
+
+func (s *MemoryStore) IncrementCounter(name string, expiration time.Time) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, ok := s.counters[name]
+	if !ok || !c.expiration.After(time.Now()) {
+		c = &memoryCounter{expiration: expiration}
+		s.counters[name] = c
+	}
+	c.count++
+	return c.count, nil
+}
+
+func (s *MemoryStore) DecrementCounter(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if c, ok := s.counters[name]; ok && c.expiration.After(time.Now()) && c.count > 0 {
+		c.count--
+	}
+	return nil
+}
+
+func (s *MemoryStore) TakeToken(name string, capacity int, period time.Duration) (bool, time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	b, ok := s.rateBuckets[name]
+	if !ok || !b.expiration.After(now) {
+		b = &memoryBucket{TokenBucket: NewTokenBucket(capacity, now)}
+		s.rateBuckets[name] = b
+	}
+	taken, wait := b.Take(capacity, period, now)
+	// the bucket is full again once unused for a period
+	b.expiration = b.LastUsed.Add(period)
+	return taken, wait, nil
+}
+
+// Ping always succeeds, the links are in memory
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+// Close stops the removal of the expired links, the next calls have no effect
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+// get returns the link for the token if it exists, has not expired and has not been
+// deleted, the mutex must be held by the caller
+func (s *MemoryStore) get(token string) *memoryLink {
+	l := s.lookup(token)
+	if l == nil || l.deleted {
+		return nil
+	}
+	return l
+}
+
+// lookup returns the link or the tombstone of the token if it has not expired,
+// the mutex must be held by the caller
+func (s *MemoryStore) lookup(token string) *memoryLink {
+	l, ok := s.links[token]
+	if !ok {
+		return nil
+	}
+	if l.expired(time.Now()) {
+		// expired: remove it now instead of waiting for the sweeper
+		delete(s.links, token)
+		delete(s.stats, token)
+		return nil
+	}
+	return l
+}
+
+// save persists the change of a link if needed, the mutex must be held by the caller
+func (s *MemoryStore) save(token string, l *memoryLink) error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist(token, l)
+}
+
+// saveKey persists the change of an API key if needed, the mutex must be held by the caller
+func (s *MemoryStore) saveKey(key *APIKey) error {
+	if s.persistKey == nil {
+		return nil
+	}
+	return s.persistKey(key)
+}
+
+// statsOf returns the statistics of the token, created if needed. The mutex must be
+// held by the caller
+func (s *MemoryStore) statsOf(token string) *memoryStats {
+	stats, ok := s.stats[token]
+	if !ok {
+		stats = &memoryStats{
+			buckets:    make(map[Granularity]map[int64]int64),
+			breakdowns: make(map[Dimension]map[string]int64),
+		}
+		s.stats[token] = stats
+	}
+	return stats
+}
+
+// saveStats persists the change of a counter if needed, the mutex must be held by the caller
+func (s *MemoryStore) saveStats(token string, counter statsCounter) error {
+	if s.persistStats == nil {
+		return nil
+	}
+	return s.persistStats(token, counter)
+}
+
+// the buckets of the granularity, created if needed
+func (stats *memoryStats) bucketsOf(granularity Granularity) map[int64]int64 {
+	if stats.buckets[granularity] == nil {
+		stats.buckets[granularity] = make(map[int64]int64)
+	}
+	return stats.buckets[granularity]
+}
+
+// the counters of the values of the dimension, created if needed
+func (stats *memoryStats) breakdownOf(dimension Dimension) map[string]int64 {
+	if stats.breakdowns[dimension] == nil {
+		stats.breakdowns[dimension] = make(map[string]int64)
+	}
+	return stats.breakdowns[dimension]
+}
+
+// counters returns all the counters of the statistics
+func (stats *memoryStats) counters() []statsCounter {
+	var counters []statsCounter
+	for granularity, buckets := range stats.buckets {
+		for start, count := range buckets {
+			counters = append(counters, statsCounter{Granularity: granularity, Start: start, Count: count})
+		}
+	}
+	for dimension, counts := range stats.breakdowns {
+		for value, count := range counts {
+			counters = append(counters, statsCounter{Dimension: dimension, Value: value, Count: count})
+		}
+	}
+	for register, rank := range stats.visitors {
+		if rank > 0 {
+			counters = append(counters, statsCounter{Register: register, Rank: rank})
+		}
+	}
+	return counters
+}
+
+// sweep periodically removes the expired links so that they do not stay in memory
+// when they are never accessed again. If set, after is called with the mutex held
+// once the expired links are removed
+func (s *MemoryStore) sweep(interval time.Duration, after func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			select {
+			case <-s.stop:
+				// closed while waiting for the mutex
+				s.mutex.Unlock()
+				return
+			default:
+			}
+			for token, l := range s.links {
+				if l.expired(now) {
+					delete(s.links, token)
+					delete(s.stats, token)
+				}
+			}
+			for name, c := range s.counters {
+				if !c.expiration.After(now) {
+					delete(s.counters, name)
+				}
+			}
+			for name, b := range s.rateBuckets {
+				if !b.expiration.After(now) {
+					delete(s.rateBuckets, name)
+				}
+			}
+			if after != nil {
+				after()
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreReserve(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	expiration := time.Now().Add(time.Hour)
+	if ok, err := s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: expiration.Unix()}); !ok || err != nil {
+		t.Fatal("Could not reserve a free token:", err)
+	}
+	if ok, _ := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: expiration.Unix()}); ok {
+		t.Error("Reserved an already used token")
+	}
+	if redirection, _ := s.GetRedirection("abc123"); redirection.Url != "http://google.com/" {
+		t.Error("Url overwritten by a failed reservation: got", redirection.Url)
+	}
+}
+
+func TestMemoryStoreConcurrentReserve(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	// only one of the concurrent reservations of a token must succeed
+	var wg sync.WaitGroup
+	reserved := make(chan bool, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, _ := s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+			reserved <- ok
+		}()
+	}
+	wg.Wait()
+	close(reserved)
+
+	count := 0
+	for ok := range reserved {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Error("Wrong number of successful reservations: got", count)
+	}
+}
+
+func TestMemoryStoreExpiration(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(-time.Second).Unix()})
+	if _, err := s.GetLink("abc123"); err != ErrNotFound {
+		t.Error("Expired link still returned, error:", err)
+	}
+	// an expired token can be reserved again
+	if ok, _ := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()}); !ok {
+		t.Error("Could not reserve an expired token")
+	}
+}
+
+func TestMemoryStoreCountAndDelete(t *testing.T) {
+	// without sweeper: the increments are called without the mutex held by RecordClicks
+	s := newMemoryStore()
+	defer s.Close()
+
+	if _, err := s.incrementCount("abc123"); err != ErrNotFound {
+		t.Error("Incremented the count of a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.incrementCount("abc123")
+	if count, _ := s.incrementCount("abc123"); count != 2 {
+		t.Error("Wrong count: got", count)
+	}
+	if count, _ := s.incrementBotCount("abc123"); count != 1 {
+		t.Error("Wrong bot count: got", count)
+	}
+	if link, _ := s.GetLink("abc123"); link.Count != 2 || link.BotCount != 1 {
+		t.Error("Wrong counts of the link: got", link)
+	}
+
+	if err := s.Delete("abc123"); err != nil {
+		t.Error("Could not delete the token:", err)
+	}
+	if err := s.Delete("abc123"); err != ErrNotFound {
+		t.Error("Deleted a missing token, error:", err)
+	}
+	// the tombstone keeps the token used
+	if ok, _ := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()}); ok {
+		t.Error("Deleted token re-issued")
+	}
+}
+
+func TestMemoryStoreUpdateUrl(t *testing.T) {
+	// without sweeper: the increments are called without the mutex held by RecordClicks
+	s := newMemoryStore()
+	defer s.Close()
+
+	if err := s.UpdateUrl("abc123", "http://example.com/"); err != ErrNotFound {
+		t.Error("Updated a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.incrementCount("abc123")
+	before, _ := s.GetLink("abc123")
+	s.UpdateUrl("abc123", "http://example.com/")
+	s.UpdateUrl("abc123", "http://example.org/")
+
+	link, _ := s.GetLink("abc123")
+	if link.Url != "http://example.org/" || link.Count != 1 || link.CreationTime != before.CreationTime {
+		t.Error("Wrong link after update: got", link)
+	}
+	if len(link.History) != 2 || link.History[0].Url != "http://google.com/" || link.History[1].Url != "http://example.com/" {
+		t.Error("Wrong history: got", link.History)
+	}
+	if len(before.History) != 0 {
+		t.Error("Link returned before the update modified: got", before.History)
+	}
+}
+
+func TestMemoryStorePermanent(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	s.Reserve("abc123", Link{Url: "http://google.com/"})
+	link, err := s.GetLink("abc123")
+	if err != nil || link.Expiration != 0 {
+		t.Error("Permanent link not found: got", link, err)
+	}
+}
+
+func TestMemoryStoreStats(t *testing.T) {
+	// without sweeper: the increments are called without the mutex held by RecordClicks
+	s := newMemoryStore()
+	defer s.Close()
+
+	now := time.Now()
+	if err := s.incrementStats("abc123", Hourly, now, time.Hour); err != ErrNotFound {
+		t.Error("Incremented the stats of a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: now.Add(time.Hour).Unix()})
+	old := now.Add(-3 * time.Hour)
+	s.incrementStats("abc123", Hourly, old, 24*time.Hour)
+	s.incrementStats("abc123", Hourly, now, 24*time.Hour)
+	s.incrementStats("abc123", Hourly, now, 24*time.Hour)
+	s.incrementStats("abc123", Daily, now, 24*time.Hour)
+
+	buckets, err := s.GetStats("abc123", Hourly, old.Add(-time.Hour), now)
+	if err != nil || len(buckets) != 2 {
+		t.Fatal("Wrong buckets: got", buckets, err)
+	}
+	if buckets[0].Start != Hourly.BucketStart(old).Unix() || buckets[0].Count != 1 ||
+		buckets[1].Start != Hourly.BucketStart(now).Unix() || buckets[1].Count != 2 {
+		t.Error("Wrong buckets: got", buckets)
+	}
+	if buckets, _ := s.GetStats("abc123", Hourly, now.Add(-2*time.Hour), now); len(buckets) != 1 {
+		t.Error("Buckets out of the period returned: got", buckets)
+	}
+	if buckets, _ := s.GetStats("abc123", Daily, now.Add(-24*time.Hour), now); len(buckets) != 1 || buckets[0].Count != 1 {
+		t.Error("Wrong daily buckets: got", buckets)
+	}
+
+	// the buckets older than the retention are removed with the next new bucket
+	s.incrementStats("abc123", Hourly, now.Add(time.Hour), time.Hour)
+	if buckets, _ := s.GetStats("abc123", Hourly, old.Add(-time.Hour), now.Add(time.Hour)); len(buckets) != 2 {
+		t.Error("Buckets older than the retention kept: got", buckets)
+	}
+
+	s.Delete("abc123")
+	if _, err := s.GetStats("abc123", Hourly, old.Add(-time.Hour), now); err != ErrNotFound {
+		t.Error("Stats of a deleted token returned, error:", err)
+	}
+}
+
+func TestMemoryStoreBreakdowns(t *testing.T) {
+	// without sweeper: the increments are called without the mutex held by RecordClicks
+	s := newMemoryStore()
+	defer s.Close()
+
+	if err := s.incrementBreakdowns("abc123", map[Dimension]string{Browser: "Firefox"}); err != ErrNotFound {
+		t.Error("Incremented the breakdowns of a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	for _, referrer := range []string{"t.co", "google.com", "t.co", "direct", "t.co", "google.com"} {
+		if err := s.incrementBreakdowns("abc123", map[Dimension]string{Referrer: referrer, Browser: "Firefox"}); err != nil {
+			t.Fatal("Could not increment the breakdowns:", err)
+		}
+	}
+	entries, err := s.GetBreakdown("abc123", Referrer, 2)
+	if err != nil || len(entries) != 2 || entries[0] != (BreakdownEntry{"t.co", 3}) || entries[1] != (BreakdownEntry{"google.com", 2}) {
+		t.Error("Wrong referrers: got", entries, err)
+	}
+	if entries, _ := s.GetBreakdown("abc123", Browser, 10); len(entries) != 1 || entries[0] != (BreakdownEntry{"Firefox", 6}) {
+		t.Error("Wrong browsers: got", entries)
+	}
+	if entries, err := s.GetBreakdown("abc123", Country, 10); err != nil || len(entries) != 0 {
+		t.Error("Wrong empty breakdown: got", entries, err)
+	}
+
+	s.Delete("abc123")
+	if _, err := s.GetBreakdown("abc123", Referrer, 10); err != ErrNotFound {
+		t.Error("Breakdowns of a deleted token returned, error:", err)
+	}
+}
+
+func TestMemoryStoreVisitors(t *testing.T) {
+	// without sweeper: the increments are called without the mutex held by RecordClicks
+	s := newMemoryStore()
+	defer s.Close()
+
+	if err := s.addVisitor("abc123", "visitor"); err != ErrNotFound {
+		t.Error("Added a visitor to a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	if count, err := s.CountVisitors("abc123"); count != 0 || err != nil {
+		t.Error("Wrong count without visitors: got", count, err)
+	}
+	for i := 0; i < 100; i++ {
+		// each visitor comes twice
+		s.addVisitor("abc123", "visitor"+strconv.Itoa(i%50))
+	}
+	if count, err := s.CountVisitors("abc123"); count < 48 || count > 52 || err != nil {
+		t.Error("Wrong count of unique visitors: got", count, err)
+	}
+
+	s.Delete("abc123")
+	if _, err := s.CountVisitors("abc123"); err != ErrNotFound {
+		t.Error("Visitors of a deleted token counted, error:", err)
+	}
+}
+
+func TestMemoryStoreRecordClicks(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+
+	now := time.Now()
+	human := Click{Token: "abc123", Time: now, Breakdowns: map[Dimension]string{Browser: "Firefox"}, Fingerprint: "visitor"}
+	clicks := []Click{
+		human,
+		human,
+		{Token: "abc123", Time: now, Bot: true},
+		// the clicks of the missing links are ignored
+		{Token: "zzz999", Time: now},
+	}
+	retention := map[Granularity]time.Duration{Hourly: time.Hour, Daily: 24 * time.Hour}
+	if err := s.RecordClicks(clicks, retention); err != nil {
+		t.Fatal("Could not record the clicks:", err)
+	}
+
+	link, _ := s.GetLink("abc123")
+	if link.Count != 2 || link.BotCount != 1 {
+		t.Error("Wrong counts: got", link.Count, link.BotCount)
+	}
+	if buckets, _ := s.GetStats("abc123", Daily, now.Add(-24*time.Hour), now); len(buckets) != 1 || buckets[0].Count != 2 {
+		t.Error("Wrong stats: got", buckets)
+	}
+	if entries, _ := s.GetBreakdown("abc123", Browser, 10); len(entries) != 1 || entries[0] != (BreakdownEntry{"Firefox", 2}) {
+		t.Error("Wrong breakdown: got", entries)
+	}
+	if visitors, _ := s.CountVisitors("abc123"); visitors != 1 {
+		t.Error("Wrong unique visitors: got", visitors)
+	}
+}
+
+func TestMemoryStoreReserveFailure(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	// the link can not be persisted: the token is not reserved
+	s.persist = func(token string, l *memoryLink) error {
+		return errors.New("disk full")
+	}
+	if ok, err := s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()}); ok || err == nil {
+		t.Error("Token reserved without being persisted: got", ok, err)
+	}
+	if _, err := s.GetLink("abc123"); err != ErrNotFound {
+		t.Error("Partial link left, error:", err)
+	}
+
+	s.persist = nil
+	if ok, err := s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()}); !ok || err != nil {
+		t.Error("Token not freed by the failure: got", ok, err)
+	}
+}
+
+// testListLinks checks the listing of the links of an owner by a store
+func testListLinks(t *testing.T, s LinkStore) {
+	expiration := time.Now().Add(time.Hour).Unix()
+	for _, token := range []string{"tok005", "tok001", "tok004", "tok002", "tok003"} {
+		s.Reserve(token, Link{Url: "http://google.com/" + token, Expiration: expiration, Owner: "team-a"})
+	}
+	s.Reserve("other1", Link{Url: "http://example.com/", Expiration: expiration, Owner: "team-b"})
+	s.Reserve("anon01", Link{Url: "http://example.com/", Expiration: expiration})
+	s.Reserve("expire", Link{Url: "http://example.com/", Expiration: time.Now().Add(-time.Second).Unix(), Owner: "team-a"})
+	s.Delete("tok003")
+
+	if link, err := s.GetLink("tok001"); err != nil || link.Owner != "team-a" {
+		t.Error("Wrong owner: got", link, err)
+	}
+
+	// by pages of 2 links, without the deleted and expired links
+	var tokens []string
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		links, next, err := s.ListLinks("team-a", cursor, 2)
+		if err != nil {
+			t.Fatal("Could not list the links:", err)
+		}
+		for _, link := range links {
+			if link.Url != "http://google.com/"+link.Token || link.Owner != "team-a" {
+				t.Error("Wrong listed link: got", link)
+			}
+			tokens = append(tokens, link.Token)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if strings.Join(tokens, ",") != "tok001,tok002,tok004,tok005" {
+		t.Error("Wrong links of the owner: got", tokens)
+	}
+
+	if links, next, err := s.ListLinks("team-c", "", 2); err != nil || len(links) != 0 || next != "" {
+		t.Error("Links listed for an owner without links: got", links, next, err)
+	}
+}
+
+func TestMemoryStoreListLinks(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	testListLinks(t, s)
+}
+
+// testCounter checks the counters of a store
+func testCounter(t *testing.T, s LinkStore) {
+	expiration := time.Now().Add(time.Hour)
+	for i := int64(1); i <= 3; i++ {
+		if count, err := s.IncrementCounter("links:a", expiration); err != nil || count != i {
+			t.Fatal("Wrong count: got", count, err, "expected", i)
+		}
+	}
+	if count, _ := s.IncrementCounter("links:b", expiration); count != 1 {
+		t.Error("Counters not independent: got", count)
+	}
+
+	// the decrements give back the increments, down to 0
+	if err := s.DecrementCounter("links:a"); err != nil {
+		t.Error("Could not decrement the counter:", err)
+	}
+	if count, _ := s.IncrementCounter("links:a", expiration); count != 3 {
+		t.Error("Counter not decremented: got", count)
+	}
+	s.DecrementCounter("links:b")
+	s.DecrementCounter("links:b")
+	if count, _ := s.IncrementCounter("links:b", expiration); count != 1 {
+		t.Error("Counter decremented below 0: got", count)
+	}
+	if err := s.DecrementCounter("links:missing"); err != nil {
+		t.Error("Could not decrement a missing counter:", err)
+	}
+
+	// an expired counter starts again from 0
+	s.IncrementCounter("links:c", time.Now().Add(time.Second))
+	time.Sleep(1100 * time.Millisecond)
+	if count, err := s.IncrementCounter("links:c", expiration); err != nil || count != 1 {
+		t.Error("Expired counter not reset: got", count, err)
+	}
+}
+
+func TestMemoryStoreCounter(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	testCounter(t, s)
+}
+
+// testTakeToken checks the token buckets of a store
+func testTakeToken(t *testing.T, s LinkStore) {
+	// the bucket holds 2 tokens, refilled by a token every 100ms
+	for i := 0; i < 2; i++ {
+		if taken, _, err := s.TakeToken("ratelimit:a", 2, 200*time.Millisecond); err != nil || !taken {
+			t.Fatal("Token not taken from a full bucket:", err)
+		}
+	}
+	taken, wait, err := s.TakeToken("ratelimit:a", 2, 200*time.Millisecond)
+	if err != nil || taken || wait <= 0 || wait > 100*time.Millisecond {
+		t.Error("Wrong wait for an empty bucket: got", taken, wait, err)
+	}
+	if taken, _, _ := s.TakeToken("ratelimit:b", 2, 200*time.Millisecond); !taken {
+		t.Error("Buckets not independent")
+	}
+
+	// a token is refilled after the wait, and only one
+	time.Sleep(wait + 10*time.Millisecond)
+	if taken, _, err := s.TakeToken("ratelimit:a", 2, 200*time.Millisecond); err != nil || !taken {
+		t.Error("Token not refilled:", err)
+	}
+	if taken, _, _ := s.TakeToken("ratelimit:a", 2, 200*time.Millisecond); taken {
+		t.Error("Too many tokens refilled")
+	}
+}
+
+func TestMemoryStoreTakeToken(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	testTakeToken(t, s)
+}
+
+func TestMemoryStoreClose(t *testing.T) {
+	s := NewMemoryStore()
+	s.Close()
+	// closing twice, e.g. by a deferred Close after an explicit one, must not panic
+	if err := s.Close(); err != nil {
+		t.Error("Could not close the store twice:", err)
+	}
+}
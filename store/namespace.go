@@ -0,0 +1,99 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// the separator of the namespace and the token, the tokens only hold letters and digits
+// so that the tokens of a namespace can not collide with the ones of another namespace
+const namespaceSeparator = ":"
+
+// WithNamespace returns a store isolating the tokens and owners of the namespace, so that the
+// same token can be used in several namespaces of a store. The store is returned as is for the
+// empty namespace
+func WithNamespace(s LinkStore, namespace string) LinkStore {
+	if namespace == "" {
+		return s
+	}
+	return &namespacedStore{LinkStore: s, prefix: namespace + namespaceSeparator}
+}
+
+// NamespacedToken returns the token of the namespace as stored in the store, to record the
+// clicks of a namespace in the store wrapped by WithNamespace
+func NamespacedToken(namespace string, token string) string {
+	if namespace == "" {
+		return token
+	}
+	return namespace + namespaceSeparator + token
+}
+
+// namespacedStore prefixes the tokens and owners with the namespace, the anonymous links of
+// the namespace are not listed. The API keys and the counters are shared by the namespaces
+type namespacedStore struct {
+	LinkStore
+	prefix string
+}
+
+func (s *namespacedStore) Reserve(token string, link Link) (bool, error) {
+	// the anonymous links stay without owner
+	if link.Owner != "" {
+		link.Owner = s.prefix + link.Owner
+	}
+	return s.LinkStore.Reserve(s.prefix+token, link)
+}
+
+func (s *namespacedStore) GetRedirection(token string) (*Redirection, error) {
+	return s.LinkStore.GetRedirection(s.prefix + token)
+}
+
+func (s *namespacedStore) GetStats(token string, granularity Granularity, from, to time.Time) ([]StatsBucket, error) {
+	return s.LinkStore.GetStats(s.prefix+token, granularity, from, to)
+}
+
+func (s *namespacedStore) GetBreakdown(token string, dimension Dimension, n int) ([]BreakdownEntry, error) {
+	return s.LinkStore.GetBreakdown(s.prefix+token, dimension, n)
+}
+
+func (s *namespacedStore) CountVisitors(token string) (int64, error) {
+	return s.LinkStore.CountVisitors(s.prefix + token)
+}
+
+func (s *namespacedStore) RecordClicks(clicks []Click, retention map[Granularity]time.Duration) error {
+	namespaced := make([]Click, len(clicks))
+	for i, click := range clicks {
+		click.Token = s.prefix + click.Token
+		namespaced[i] = click
+	}
+	return s.LinkStore.RecordClicks(namespaced, retention)
+}
+
+func (s *namespacedStore) UpdateUrl(token string, url string) error {
+	return s.LinkStore.UpdateUrl(s.prefix+token, url)
+}
+
+func (s *namespacedStore) GetLink(token string) (*Link, error) {
+	link, err := s.LinkStore.GetLink(s.prefix + token)
+	if err != nil {
+		return nil, err
+	}
+	link.Owner = strings.TrimPrefix(link.Owner, s.prefix)
+	return link, nil
+}
+
+func (s *namespacedStore) ListLinks(owner string, cursor string, n int) ([]OwnedLink, string, error) {
+	// the tokens of the owner in the namespace all have the prefix, it is the first cursor
+	links, next, err := s.LinkStore.ListLinks(s.prefix+owner, s.prefix+cursor, n)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range links {
+		links[i].Token = strings.TrimPrefix(links[i].Token, s.prefix)
+		links[i].Owner = owner
+	}
+	return links, strings.TrimPrefix(next, s.prefix), nil
+}
+
+func (s *namespacedStore) Delete(token string) error {
+	return s.LinkStore.Delete(s.prefix + token)
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNamespace(t *testing.T) {
+	s := NewMemoryStore()
+	defer s.Close()
+
+	expiration := time.Now().Add(time.Hour).Unix()
+	a := WithNamespace(s, "a")
+	b := WithNamespace(s, "b")
+	if WithNamespace(s, "") != LinkStore(s) {
+		t.Error("The empty namespace wraps the store")
+	}
+
+	// the same token in each namespace
+	for ns, store := range map[string]LinkStore{"a": a, "b": b} {
+		reserved, err := store.Reserve("abc123", Link{Url: "http://" + ns + ".com/", Expiration: expiration, Owner: "key1"})
+		if err != nil || !reserved {
+			t.Fatal("Token not reserved in", ns, "got", reserved, err)
+		}
+	}
+	if redirection, _ := b.GetRedirection("abc123"); redirection == nil || redirection.Url != "http://b.com/" {
+		t.Error("Wrong redirection in the namespace: got", redirection)
+	}
+	if _, err := s.GetRedirection("abc123"); err != ErrNotFound {
+		t.Error("Token of a namespace found without namespace: got", err)
+	}
+	if link, _ := s.GetLink(NamespacedToken("a", "abc123")); link == nil || link.Owner != "a:key1" {
+		t.Error("Wrong stored link: got", link)
+	}
+
+	// the owner is returned without namespace
+	link, err := a.GetLink("abc123")
+	if err != nil || link.Owner != "key1" {
+		t.Error("Wrong owner: got", link, err)
+	}
+
+	// the links of the owner are listed by namespace
+	a.Reserve("abc124", Link{Url: "http://a.com/2", Expiration: expiration, Owner: "key1"})
+	a.Reserve("abc125", Link{Url: "http://a.com/3", Expiration: expiration})
+	links, next, err := a.ListLinks("key1", "", 1)
+	if err != nil || len(links) != 1 || links[0].Token != "abc123" || links[0].Owner != "key1" || next != "abc123" {
+		t.Fatal("Wrong first page: got", links, next, err)
+	}
+	links, next, _ = a.ListLinks("key1", next, 1)
+	if len(links) != 1 || links[0].Token != "abc124" {
+		t.Error("Wrong second page: got", links, next)
+	}
+	if links, _, _ := b.ListLinks("key1", "", 10); len(links) != 1 {
+		t.Error("Links of another namespace listed: got", links)
+	}
+
+	// the clicks of the namespace recorded in the store
+	s.RecordClicks([]Click{{Token: NamespacedToken("b", "abc123"), Time: time.Now()}}, nil)
+	if link, _ := b.GetLink("abc123"); link.Count != 1 {
+		t.Error("Click not recorded: got", link.Count)
+	}
+	if link, _ := a.GetLink("abc123"); link.Count != 0 {
+		t.Error("Click recorded in another namespace: got", link.Count)
+	}
+
+	if err := a.Delete("abc123"); err != nil {
+		t.Error("Link not deleted: got", err)
+	}
+	if _, err := b.GetLink("abc123"); err != nil {
+		t.Error("Link of another namespace deleted: got", err)
+	}
+}
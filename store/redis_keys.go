@@ -0,0 +1,76 @@
+package store
+
+import (
+	"strings"
+)
+
+// the version of the layout of the keys, to change when the layout changes so that
+// the keys of different layouts do not collide
+const redisKeysVersion = "v1"
+
+// redisKeys builds the keys used by the RedisStore: <prefix>:v1:<type>:<id>
+// The prefix isolates the service's data from the other data of the same redis DB
+type redisKeys struct {
+	prefix string
+}
+
+func newRedisKeys(prefix string) redisKeys {
+	return redisKeys{prefix: prefix}
+}
+
+// the key of the hash holding a link
+func (k redisKeys) link(token string) string {
+	return k.key("link", token)
+}
+
+// the key of the hash holding the click counters of a link for a granularity, by start
+// of the bucket. The key of the link is the hash tag of the key so that both keys are
+// in the same slot of a cluster and can be used by the same script
+func (k redisKeys) stats(token string, granularity Granularity) string {
+	return "{" + k.link(token) + "}:stats:" + string(granularity)
+}
+
+// the key of the sorted set holding the click counters of a link by value of a dimension,
+// in the same slot as the link
+func (k redisKeys) breakdown(token string, dimension Dimension) string {
+	return "{" + k.link(token) + "}:breakdown:" + string(dimension)
+}
+
+// the key of the HyperLogLog of the unique visitors of a link, in the same slot as the link
+func (k redisKeys) visitors(token string) string {
+	return "{" + k.link(token) + "}:visitors"
+}
+
+// the key of the sorted set of the tokens of the links of an owner, sorted by token
+func (k redisKeys) ownerLinks(owner string) string {
+	return k.key("owner", owner, "links")
+}
+
+// the key of the set of the IDs of the API keys. It is its own hash tag, and the hash tag
+// of the keys of the API keys, so that a key is added to the set by the same script
+func (k redisKeys) apiKeys() string {
+	return "{" + k.key("apikeys") + "}"
+}
+
+// the key of the hash holding an API key, in the same slot as the set of the API keys
+func (k redisKeys) apiKey(id string) string {
+	return k.apiKeys() + ":" + id
+}
+
+// the key of a counter of the quotas, removed by redis once expired
+func (k redisKeys) counter(name string) string {
+	return k.key("counter", name)
+}
+
+// the key of the hash holding a token bucket of the rate limits, removed by redis once full
+func (k redisKeys) rateBucket(name string) string {
+	return k.key("bucket", name)
+}
+
+func (k redisKeys) key(parts ...string) string {
+	elems := append([]string{redisKeysVersion}, parts...)
+	if k.prefix != "" {
+		elems = append([]string{k.prefix}, elems...)
+	}
+	return strings.Join(elems, ":")
+}
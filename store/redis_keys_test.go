@@ -0,0 +1,29 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestRedisKeys(t *testing.T) {
+	if key := newRedisKeys("shorturls").link("abc123"); key != "shorturls:v1:link:abc123" {
+		t.Error("Wrong key: got", key)
+	}
+	if key := newRedisKeys("").link("abc123"); key != "v1:link:abc123" {
+		t.Error("Wrong key without prefix: got", key)
+	}
+	if key := newRedisKeys("shorturls").stats("abc123", Hourly); key != "{shorturls:v1:link:abc123}:stats:hour" {
+		t.Error("Wrong stats key: got", key)
+	}
+	if key := newRedisKeys("shorturls").visitors("abc123"); key != "{shorturls:v1:link:abc123}:visitors" {
+		t.Error("Wrong visitors key: got", key)
+	}
+	if key := newRedisKeys("shorturls").apiKey("0123abcd"); key != "{shorturls:v1:apikeys}:0123abcd" {
+		t.Error("Wrong API key key: got", key)
+	}
+	if key := newRedisKeys("shorturls").ownerLinks("0123abcd"); key != "shorturls:v1:owner:0123abcd:links" {
+		t.Error("Wrong owner key: got", key)
+	}
+	if key := newRedisKeys("shorturls").counter("links:hr:20261018"); key != "shorturls:v1:counter:links:hr:20261018" {
+		t.Error("Wrong counter key: got", key)
+	}
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// the links stored before the versioned layout used the bare token as key
+var bareTokenKey = regexp.MustCompile("^[0-9a-zA-Z]+$")
+
+// rename the link (KEYS[1]) to the versioned key (KEYS[2]) if it is free, and set the
+// expiration field from the TTL of the link: the links stored before the versioned layout
+// only had the TTL. ARGV: the current time in milliseconds. Returns 0 if the key is used
+var migrateLinkScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('RENAME', KEYS[1], KEYS[2])
+if redis.call('HEXISTS', KEYS[2], 'expiration') == 0 then
+	local expiration = 0
+	if ttl > 0 then
+		expiration = math.ceil((tonumber(ARGV[1]) + ttl) / 1000)
+	end
+	redis.call('HSET', KEYS[2], 'expiration', string.format('%d', expiration))
+end
+return 1
+`)
+
+// MigrateRedisKeys renames the links stored as hashes keyed by the bare token to the
+// versioned layout with the given prefix. The renaming keeps the expiration of the links,
+// which is also recorded in their expiration field. It returns the number of links
+// migrated. It can be run again if interrupted: the links already migrated are not found
+// anymore under their bare token
+func MigrateRedisKeys(client *redis.Client, prefix string) (int, error) {
+	keys := newRedisKeys(prefix)
+	migrated := 0
+
+	var cursor int64
+	for {
+		next, found, err := client.Scan(cursor, "*", 100).Result()
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, key := range found {
+			if !bareTokenKey.MatchString(key) {
+				continue
+			}
+			// only the hashes with an url are links
+			if keyType, err := client.Type(key).Result(); err != nil {
+				return migrated, err
+			} else if keyType != "hash" {
+				continue
+			}
+			if isLink, err := client.HExists(key, "url").Result(); err != nil {
+				return migrated, err
+			} else if !isLink {
+				continue
+			}
+
+			// a link already stored under the new key is not overwritten
+			renamed, err := migrateLinkScript.Run(client, []string{key, keys.link(key)},
+				[]string{strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)}).Result()
+			if err != nil {
+				return migrated, err
+			}
+			if n, _ := renamed.(int64); n == 0 {
+				log.WithField("token", key).Warn("token already used in the new layout, not migrated")
+				continue
+			}
+			migrated++
+		}
+
+		if next == 0 {
+			return migrated, nil
+		}
+		cursor = next
+	}
+}
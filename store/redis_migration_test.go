@@ -0,0 +1,47 @@
+package store
+
+import (
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"testing"
+	"time"
+)
+
+func TestMigrateRedisKeys(t *testing.T) {
+	s, server, stop := newTestRedisStore(t)
+	defer stop()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	// the links of the previous versions, with a TTL and without expiration field
+	client.HMSet("abc123", "url", "http://google.com/", "creationTime", "1", "count", "3")
+	client.Expire("abc123", time.Hour)
+	client.HMSet("perm01", "url", "http://example.com/", "creationTime", "1", "count", "0")
+	client.Set("other", "x", 0)
+	client.HMSet("notalink", "foo", "bar")
+	// a token already used in the new layout is not overwritten
+	s.Reserve("used01", Link{Url: "http://example.org/", Expiration: time.Now().Add(time.Hour).Unix()})
+	client.HMSet("used01", "url", "http://google.com/")
+
+	migrated, err := MigrateRedisKeys(client, "shorturls")
+	if migrated != 2 || err != nil {
+		t.Fatal("Wrong migration: got", migrated, err)
+	}
+
+	link, err := s.GetLink("abc123")
+	if err != nil || link.Count != 3 || link.Expiration < time.Now().Add(time.Hour-time.Minute).Unix() ||
+		link.Expiration > time.Now().Add(time.Hour+time.Second).Unix() {
+		t.Error("Wrong migrated link: got", link, err)
+	}
+	if ttl := server.TTL("shorturls:v1:link:abc123"); ttl <= 0 {
+		t.Error("TTL of the link lost: got", ttl)
+	}
+	if link, err := s.GetLink("perm01"); err != nil || link.Expiration != 0 {
+		t.Error("Wrong migrated permanent link: got", link, err)
+	}
+	if link, _ := s.GetLink("used01"); link == nil || link.Url != "http://example.org/" {
+		t.Error("Link of the new layout overwritten: got", link)
+	}
+	if !server.Exists("other") || !server.Exists("notalink") || !server.Exists("used01") {
+		t.Error("Keys which are not links migrated: got", server.Keys())
+	}
+}
@@ -0,0 +1,598 @@
+package store
+
+import (
+	"encoding/json"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisClient holds the redis commands used by the store. It is implemented by
+// the standalone and sentinel clients (*redis.Client) and by the cluster client
+// (*redis.ClusterClient)
+type RedisClient interface {
+	HGet(key, field string) *redis.StringCmd
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	SMembers(key string) *redis.StringSliceCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	ZRangeByLex(key string, opt redis.ZRangeByScore) *redis.StringSliceCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	ScriptExists(scripts ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+	Process(cmd redis.Cmder) // for the commands without method, eg: PFCOUNT
+	Ping() *redis.StatusCmd
+	Close() error
+}
+
+// create the link if the token is free: the url field is only missing if there is
+// no link, the tombstones keep the token used. The statistics of a previous link of
+// the token (KEYS[2..]) are removed. ARGV: the url, the creation time, the expiration
+// (0 for no expiration), the redirect status and the owner. Returns 0 if the token is used
+var reserveScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'url') == 1 then
+	return 0
+end
+if #KEYS > 1 then
+	redis.call('DEL', unpack(KEYS, 2))
+end
+redis.call('HMSET', KEYS[1], 'url', ARGV[1], 'creationTime', ARGV[2], 'count', '0', 'botCount', '0',
+	'expiration', ARGV[3], 'redirectStatus', ARGV[4], 'owner', ARGV[5])
+if ARGV[3] ~= '0' then
+	redis.call('EXPIREAT', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// replace the url of the link and append the previous one to the JSON history
+// of the link. Returns false if there is no link
+var updateUrlScript = redis.NewScript(`
+local url = redis.call('HGET', KEYS[1], 'url')
+if not url or url == '' then
+	return false
+end
+local history = redis.call('HGET', KEYS[1], 'history')
+local edits = {}
+if history then
+	edits = cjson.decode(history)
+end
+table.insert(edits, {url = url, editTime = tonumber(ARGV[2])})
+redis.call('HMSET', KEYS[1], 'url', ARGV[1], 'history', cjson.encode(edits))
+return 1
+`)
+
+// add the API key (KEYS[1]) and its ID to the set of the API keys (KEYS[2]) if the key
+// does not exist. ARGV: the ID, the name, the hash, the scopes, the creation time and the
+// tenant. Returns 0 if the key exists
+var addKeyScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'name', ARGV[2], 'hash', ARGV[3], 'scopes', ARGV[4], 'creationTime', ARGV[5],
+	'revokedTime', '0', 'tenant', ARGV[6])
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1
+`)
+
+// set the revocation time of the API key if it is not revoked. ARGV: the revocation
+// time. Returns 0 if there is no key
+var revokeKeyScript = redis.NewScript(`
+local revoked = redis.call('HGET', KEYS[1], 'revokedTime')
+if not revoked then
+	return 0
+end
+if revoked == '0' then
+	redis.call('HSET', KEYS[1], 'revokedTime', ARGV[1])
+end
+return 1
+`)
+
+// increment the counter (KEYS[1]) and set its expiration when it is created. ARGV: the
+// expiration as a unix timestamp. Returns the new value of the counter
+var incrementCounterScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('EXPIREAT', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// decrement the counter (KEYS[1]) if it exists and is above 0, an expired counter has been
+// removed by redis
+var decrementCounterScript = redis.NewScript(`
+local count = tonumber(redis.call('GET', KEYS[1]))
+if count and count > 0 then
+	redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
+// take a token from the bucket (KEYS[1]), a hash holding its tokens and the time of its last
+// use, after refilling it for the time elapsed. ARGV: the capacity, the period in which the
+// capacity is refilled and the current time, in milliseconds. Returns 0 if a token is taken,
+// the milliseconds until the bucket holds a token otherwise
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'lastUsed')
+local tokens = tonumber(bucket[1])
+local lastUsed = tonumber(bucket[2])
+if not tokens or not lastUsed then
+	tokens = capacity
+	lastUsed = now
+end
+if now > lastUsed then
+	tokens = math.min(capacity, tokens + (now - lastUsed) * capacity / period)
+	lastUsed = now
+end
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * period / capacity)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'lastUsed', lastUsed)
+-- the bucket is full again once unused for a period
+redis.call('PEXPIRE', KEYS[1], period)
+return wait
+`)
+
+// replace the link by a tombstone: a hash with an empty url which keeps the token used
+// (the reservation fails while it has a url) until the link expires, and remove its statistics.
+// Returns 0 if there was no link
+var deleteScript = redis.NewScript(`
+local url = redis.call('HGET', KEYS[1], 'url')
+if not url or url == '' then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('DEL', unpack(KEYS))
+redis.call('HMSET', KEYS[1], 'url', '', 'deleted', ARGV[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// record a click if the link exists: the bot count of a bot, or the count, the
+// statistics (KEYS[2..3]), the breakdowns (KEYS[4..8]) and the visitors (KEYS[9])
+// of a human. ARGV[1] is 1 for a bot, then the start, the retention cutoff and the
+// expiration of the bucket of each granularity, the value of each dimension (empty
+// to skip it) and the fingerprint of the visitor (empty to skip it).
+// Returns 0 if there is no link
+var recordClickScript = redis.NewScript(`
+local url = redis.call('HGET', KEYS[1], 'url')
+if not url or url == '' then
+	return 0
+end
+if ARGV[1] == '1' then
+	redis.call('HINCRBY', KEYS[1], 'botCount', 1)
+	return 1
+end
+redis.call('HINCRBY', KEYS[1], 'count', 1)
+for i = 0, 1 do
+	local key, start, cutoff = KEYS[2 + i], ARGV[2 + 3 * i], tonumber(ARGV[3 + 3 * i])
+	if redis.call('HINCRBY', key, start, 1) == 1 then
+		for _, previous in ipairs(redis.call('HKEYS', key)) do
+			if tonumber(previous) < cutoff then
+				redis.call('HDEL', key, previous)
+			end
+		end
+	end
+	redis.call('EXPIREAT', key, ARGV[4 + 3 * i])
+end
+local ttl = redis.call('PTTL', KEYS[1])
+for i = 4, 9 do
+	local value = ARGV[i + 4]
+	if value ~= '' then
+		if i == 9 then
+			redis.call('PFADD', KEYS[i], value)
+		else
+			redis.call('ZINCRBY', KEYS[i], 1, value)
+		end
+		if ttl > 0 then
+			redis.call('PEXPIRE', KEYS[i], ttl)
+		end
+	end
+end
+return 1
+`)
+
+// redisPipeline holds the commands sent in the pipelines of the store, it is
+// implemented by *redis.Pipeline and *redis.ClusterPipeline
+type redisPipeline interface {
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	ScriptExists(scripts ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+	Exec() ([]redis.Cmder, error)
+	Close() error
+}
+
+// RedisStore stores the links as Redis hashes, the keys are built by redisKeys
+type RedisStore struct {
+	client   RedisClient
+	keys     redisKeys
+	pipeline func() redisPipeline // nil if the client has no pipelines
+}
+
+// NewRedisStore creates a store backed by the given redis client, all the keys
+// start with the given prefix
+func NewRedisStore(client RedisClient, prefix string) *RedisStore {
+	s := &RedisStore{client: client, keys: newRedisKeys(prefix)}
+	// the pipelines of the clients have different types
+	switch c := client.(type) {
+	case *redis.Client:
+		s.pipeline = func() redisPipeline { return c.Pipeline() }
+	case *redis.ClusterClient:
+		s.pipeline = func() redisPipeline { return c.Pipeline() }
+	}
+	return s
+}
+
+func (s *RedisStore) Reserve(token string, link Link) (bool, error) {
+	// a script so that the link is created with its metadata and expiration at once:
+	// no link without expiration is left if the server or redis fail in between
+	reserved, err := reserveScript.Run(s.client, append([]string{s.keys.link(token)}, s.statsKeys(token)...),
+		[]string{link.Url, strconv.FormatInt(time.Now().Unix(), 10), strconv.FormatInt(link.Expiration, 10),
+			strconv.Itoa(link.RedirectStatus), link.Owner}).Result()
+	if err != nil {
+		return false, err
+	} else if n, _ := reserved.(int64); n == 0 {
+		return false, nil
+	}
+
+	// the index of the links of the owner is on another node of a cluster: it is updated
+	// after the creation, and its entries are checked against the links when listing
+	if link.Owner != "" {
+		err = s.client.ZAdd(s.keys.ownerLinks(link.Owner), redis.Z{Member: token}).Err()
+		if err != nil {
+			log.WithError(err).WithField("token", token).Error("could not add the link to the links of its owner")
+		}
+	}
+	return true, nil
+}
+
+func (s *RedisStore) GetRedirection(token string) (*Redirection, error) {
+	values, err := s.client.HMGet(s.keys.link(token), "url", "redirectStatus").Result()
+	if err != nil {
+		return nil, err
+	}
+	// the missing fields are nil, the url of a tombstone is empty
+	url, _ := values[0].(string)
+	if url == "" {
+		return nil, ErrNotFound
+	}
+	redirection := Redirection{Url: url}
+	if status, ok := values[1].(string); ok {
+		redirection.Status, _ = strconv.Atoi(status)
+	}
+	return &redirection, nil
+}
+
+func (s *RedisStore) GetStats(token string, granularity Granularity, from, to time.Time) ([]StatsBucket, error) {
+	if err := s.exists(token); err != nil {
+		return nil, err
+	}
+
+	values, err := s.client.HGetAllMap(s.keys.stats(token, granularity)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	buckets := make(map[int64]int64, len(values))
+	for start, count := range values {
+		bucketStart, err := strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets[bucketStart], _ = strconv.ParseInt(count, 10, 64)
+	}
+	return filterBuckets(buckets, from, to), nil
+}
+
+func (s *RedisStore) GetBreakdown(token string, dimension Dimension, n int) ([]BreakdownEntry, error) {
+	if err := s.exists(token); err != nil {
+		return nil, err
+	}
+
+	values, err := s.client.ZRevRangeWithScores(s.keys.breakdown(token, dimension), 0, int64(n-1)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	entries := make([]BreakdownEntry, len(values))
+	for i, z := range values {
+		entries[i].Value, _ = z.Member.(string)
+		entries[i].Count = int64(z.Score)
+	}
+	// same order as the other stores for the values with the same count
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (s *RedisStore) CountVisitors(token string) (int64, error) {
+	if err := s.exists(token); err != nil {
+		return 0, err
+	}
+	// no PFCOUNT method in the client
+	cmd := redis.NewIntCmd("PFCOUNT", s.keys.visitors(token))
+	s.client.Process(cmd)
+	return cmd.Result()
+}
+
+func (s *RedisStore) RecordClicks(clicks []Click, retention map[Granularity]time.Duration) error {
+	if s.pipeline == nil {
+		for _, click := range clicks {
+			keys, args := s.clickArgs(click, retention)
+			if err := recordClickScript.Run(s.client, keys, args).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// the scripts of all the clicks in one round-trip, the script is sent again for
+	// the clicks of the nodes which do not have it in their cache yet
+	failed, err := s.runPipelined(clicks, retention, true)
+	if err == nil && len(failed) > 0 {
+		_, err = s.runPipelined(failed, retention, false)
+	}
+	return err
+}
+
+// runPipelined runs the script of the clicks in a pipeline, with EVALSHA if cached.
+// It returns the clicks which failed as the script was not cached
+func (s *RedisStore) runPipelined(clicks []Click, retention map[Granularity]time.Duration, cached bool) ([]Click, error) {
+	pipeline := s.pipeline()
+	defer pipeline.Close()
+	cmds := make([]*redis.Cmd, len(clicks))
+	for i, click := range clicks {
+		keys, args := s.clickArgs(click, retention)
+		if cached {
+			cmds[i] = recordClickScript.EvalSha(pipeline, keys, args)
+		} else {
+			cmds[i] = recordClickScript.Eval(pipeline, keys, args)
+		}
+	}
+	// the errors are checked command by command
+	pipeline.Exec()
+
+	var failed []Click
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil && cached && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			failed = append(failed, clicks[i])
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return failed, nil
+}
+
+// the keys and arguments of the script recording the click
+func (s *RedisStore) clickArgs(click Click, retention map[Granularity]time.Duration) ([]string, []string) {
+	keys := []string{s.keys.link(click.Token)}
+	args := []string{"0"}
+	if click.Bot {
+		args[0] = "1"
+	}
+	for _, granularity := range Granularities {
+		start := granularity.BucketStart(click.Time)
+		keys = append(keys, s.keys.stats(click.Token, granularity))
+		args = append(args, strconv.FormatInt(start.Unix(), 10),
+			strconv.FormatInt(start.Add(-retention[granularity]).Unix(), 10),
+			strconv.FormatInt(start.Add(granularity.Duration()+retention[granularity]).Unix(), 10))
+	}
+	for _, dimension := range Dimensions {
+		keys = append(keys, s.keys.breakdown(click.Token, dimension))
+		args = append(args, breakdownValue(click.Breakdowns[dimension]))
+	}
+	keys = append(keys, s.keys.visitors(click.Token))
+	return keys, append(args, click.Fingerprint)
+}
+
+func (s *RedisStore) GetLink(token string) (*Link, error) {
+	value, err := s.client.HGetAllMap(s.keys.link(token)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	} else if value["url"] == "" {
+		// an empty map is returned if the key does not exist, tombstones have no url
+		return nil, ErrNotFound
+	}
+
+	link := Link{Url: value["url"]}
+	// the fields may be missing if the link is being created
+	link.CreationTime, _ = strconv.ParseInt(value["creationTime"], 10, 64)
+	link.Count, _ = strconv.ParseInt(value["count"], 10, 64)
+	link.BotCount, _ = strconv.ParseInt(value["botCount"], 10, 64)
+	link.Expiration, _ = strconv.ParseInt(value["expiration"], 10, 64)
+	link.RedirectStatus, _ = strconv.Atoi(value["redirectStatus"])
+	link.Owner = value["owner"]
+	if history, ok := value["history"]; ok {
+		if err := json.Unmarshal([]byte(history), &link.History); err != nil {
+			return nil, err
+		}
+	}
+	return &link, nil
+}
+
+func (s *RedisStore) ListLinks(owner string, cursor string, n int) ([]OwnedLink, string, error) {
+	key := s.keys.ownerLinks(owner)
+	min := "-"
+	if cursor != "" {
+		min = "(" + cursor
+	}
+
+	// one more link to know if there are links after the page. The tokens of the links
+	// which expired, were deleted or re-issued are skipped and removed from the index
+	links := []OwnedLink{}
+	var stale []string
+	for len(links) <= n {
+		count := int64(n + 1 - len(links))
+		tokens, err := s.client.ZRangeByLex(key, redis.ZRangeByScore{Min: min, Max: "+", Count: count}).Result()
+		if err != nil && err != redis.Nil {
+			return nil, "", err
+		}
+		for _, token := range tokens {
+			link, err := s.GetLink(token)
+			if err == ErrNotFound || (err == nil && link.Owner != owner) {
+				stale = append(stale, token)
+				continue
+			} else if err != nil {
+				return nil, "", err
+			}
+			link.History = nil
+			links = append(links, OwnedLink{Token: token, Link: *link})
+		}
+		if int64(len(tokens)) < count {
+			break
+		}
+		min = "(" + tokens[len(tokens)-1]
+	}
+	if len(stale) > 0 {
+		if err := s.client.ZRem(key, stale...).Err(); err != nil {
+			log.WithError(err).WithField("owner", owner).Warn("could not remove the stale links of the owner")
+		}
+	}
+
+	links, next := pageLinks(links, cursor, n)
+	return links, next, nil
+}
+
+func (s *RedisStore) UpdateUrl(token string, url string) error {
+	// the script makes the update and the history change atomic
+	err := updateUrlScript.Run(s.client, []string{s.keys.link(token)},
+		[]string{url, strconv.FormatInt(time.Now().Unix(), 10)}).Err()
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *RedisStore) Delete(token string) error {
+	deleted, err := deleteScript.Run(s.client, append([]string{s.keys.link(token)}, s.statsKeys(token)...),
+		[]string{strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return err
+	} else if n, _ := deleted.(int64); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *RedisStore) AddKey(key APIKey) error {
+	added, err := addKeyScript.Run(s.client, []string{s.keys.apiKey(key.ID), s.keys.apiKeys()},
+		[]string{key.ID, key.Name, key.Hash, joinScopes(key.Scopes), strconv.FormatInt(key.CreationTime, 10), key.Tenant}).Result()
+	if err != nil {
+		return err
+	} else if n, _ := added.(int64); n == 0 {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func (s *RedisStore) GetKey(id string) (*APIKey, error) {
+	value, err := s.client.HGetAllMap(s.keys.apiKey(id)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	} else if len(value) == 0 {
+		return nil, ErrNotFound
+	}
+
+	key := APIKey{ID: id, Name: value["name"], Tenant: value["tenant"], Hash: value["hash"], Scopes: splitScopes(value["scopes"])}
+	key.CreationTime, _ = strconv.ParseInt(value["creationTime"], 10, 64)
+	key.RevokedTime, _ = strconv.ParseInt(value["revokedTime"], 10, 64)
+	return &key, nil
+}
+
+func (s *RedisStore) ListKeys() ([]APIKey, error) {
+	ids, err := s.client.SMembers(s.keys.apiKeys()).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	keys := make([]APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := s.GetKey(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+func (s *RedisStore) RevokeKey(id string) error {
+	revoked, err := revokeKeyScript.Run(s.client, []string{s.keys.apiKey(id)},
+		[]string{strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return err
+	} else if n, _ := revoked.(int64); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *RedisStore) IncrementCounter(name string, expiration time.Time) (int64, error) {
+	// redis removes the counter once expired, the next increment creates it again
+	count, err := incrementCounterScript.Run(s.client, []string{s.keys.counter(name)},
+		[]string{strconv.FormatInt(expiration.Unix(), 10)}).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, _ := count.(int64)
+	return n, nil
+}
+
+func (s *RedisStore) DecrementCounter(name string) error {
+	return decrementCounterScript.Run(s.client, []string{s.keys.counter(name)}, nil).Err()
+}
+
+func (s *RedisStore) TakeToken(name string, capacity int, period time.Duration) (bool, time.Duration, error) {
+	// the time of the server is given to the script, so that the script can be replicated
+	wait, err := takeTokenScript.Run(s.client, []string{s.keys.rateBucket(name)}, []string{strconv.Itoa(capacity),
+		strconv.FormatInt(int64(period/time.Millisecond), 10), strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)}).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	ms, _ := wait.(int64)
+	return ms == 0, time.Duration(ms) * time.Millisecond, nil
+}
+
+// exists returns ErrNotFound if the token has no link
+func (s *RedisStore) exists(token string) error {
+	url, err := s.client.HGet(s.keys.link(token), "url").Result()
+	if err == redis.Nil || (err == nil && url == "") {
+		return ErrNotFound
+	}
+	return err
+}
+
+// the keys of the statistics, breakdowns and visitors of the link
+func (s *RedisStore) statsKeys(token string) []string {
+	var keys []string
+	for _, granularity := range Granularities {
+		keys = append(keys, s.keys.stats(token, granularity))
+	}
+	for _, dimension := range Dimensions {
+		keys = append(keys, s.keys.breakdown(token, dimension))
+	}
+	return append(keys, s.keys.visitors(token))
+}
+
+// Ping sends a PING to redis
+func (s *RedisStore) Ping() error {
+	return s.client.Ping().Err()
+}
+
+// Close closes the redis client
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/alicebob/miniredis/v2"
+	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"testing"
+	"time"
+)
+
+// recordingClient records the commands sent by the store to a redis which can not be
+// reached, all the commands fail
+type recordingClient struct {
+	*redis.Client
+	commands []string
+}
+
+func (c *recordingClient) EvalSha(sha1 string, keys []string, args []string) *redis.Cmd {
+	c.commands = append(c.commands, "EVALSHA")
+	return c.Client.EvalSha(sha1, keys, args)
+}
+
+func (c *recordingClient) Eval(script string, keys []string, args []string) *redis.Cmd {
+	c.commands = append(c.commands, "EVAL")
+	return c.Client.Eval(script, keys, args)
+}
+
+func TestRedisStoreReserveFailure(t *testing.T) {
+	// nothing listens on the port 1
+	client := &recordingClient{Client: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond, MaxRetries: 0})}
+	s := NewRedisStore(client, "shorturls")
+	defer s.Close()
+
+	reserved, err := s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	if reserved || err == nil {
+		t.Error("Token reserved without redis: got", reserved, err)
+	}
+	// the link is created by a single script: a failure can not leave a partial link
+	for _, command := range client.commands {
+		if command != "EVALSHA" && command != "EVAL" {
+			t.Error("Link created by several commands: got", client.commands)
+		}
+	}
+	if len(client.commands) == 0 {
+		t.Error("No command sent")
+	}
+}
+
+// newTestRedisStore creates a store backed by an in-memory redis, stopped by the returned function
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis, func()) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal("Could not start redis:", err)
+	}
+	s := NewRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}), "shorturls")
+	return s, server, func() {
+		s.Close()
+		server.Close()
+	}
+}
+
+func TestRedisStoreRecordMissing(t *testing.T) {
+	s, server, stop := newTestRedisStore(t)
+	defer stop()
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	clicks := []Click{{Token: "abc123", Time: time.Now()}, {Token: "abc123", Time: time.Now(), Bot: true}}
+	if err := s.RecordClicks(clicks, map[Granularity]time.Duration{Hourly: time.Hour, Daily: time.Hour}); err != nil {
+		t.Fatal("Could not record the clicks:", err)
+	}
+	if link, _ := s.GetLink("abc123"); link == nil || link.Count != 1 || link.BotCount != 1 {
+		t.Error("Wrong counts: got", link)
+	}
+
+	// the clicks of an expired or deleted link do not create a link without expiration
+	server.FastForward(2 * time.Hour)
+	s.Reserve("def456", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.Delete("def456")
+	for _, token := range []string{"abc123", "def456", "zzz999"} {
+		clicks := []Click{{Token: token, Time: time.Now(), Breakdowns: map[Dimension]string{Country: "FR"}, Fingerprint: "visitor"},
+			{Token: token, Time: time.Now(), Bot: true}}
+		if err := s.RecordClicks(clicks, map[Granularity]time.Duration{Hourly: time.Hour, Daily: time.Hour}); err != nil {
+			t.Error("Clicks of a missing link not ignored: got", err)
+		}
+	}
+	for _, key := range server.Keys() {
+		if server.TTL(key) <= 0 {
+			t.Error("Key without expiration:", key)
+		}
+	}
+}
+
+func TestRedisStoreDecrementCounter(t *testing.T) {
+	s, server, stop := newTestRedisStore(t)
+	defer stop()
+
+	expiration := time.Now().Add(time.Hour)
+	s.IncrementCounter("links:a", expiration)
+	s.IncrementCounter("links:a", expiration)
+	if err := s.DecrementCounter("links:a"); err != nil {
+		t.Fatal("Could not decrement the counter:", err)
+	}
+	if count, _ := s.IncrementCounter("links:a", expiration); count != 2 {
+		t.Error("Counter not decremented: got", count)
+	}
+
+	// no counter below 0, nor without expiration
+	s.DecrementCounter("links:b")
+	if server.Exists("shorturls:v1:counter:links:b") {
+		t.Error("Missing counter created")
+	}
+	server.FastForward(2 * time.Hour)
+	s.DecrementCounter("links:a")
+	if count, _ := s.IncrementCounter("links:a", time.Now().Add(time.Hour)); count != 1 {
+		t.Error("Expired counter decremented: got", count)
+	}
+}
+
+func TestRedisStoreTakeToken(t *testing.T) {
+	s, server, stop := newTestRedisStore(t)
+	defer stop()
+
+	testTakeToken(t, s)
+	// the buckets are removed once full again
+	if ttl := server.TTL("shorturls:v1:bucket:ratelimit:a"); ttl <= 0 || ttl > 200*time.Millisecond {
+		t.Error("Wrong expiration of the bucket: got", ttl)
+	}
+}
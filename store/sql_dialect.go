@@ -0,0 +1,82 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// sqlDialect holds what differs between the SQL databases supported by the SQLStore
+type sqlDialect struct {
+	name string
+
+	// the bind parameters are written "?" in the queries, some databases use "$1, $2..."
+	numberedParams bool
+
+	// format of an INSERT that does nothing if the row violates a unique constraint,
+	// the %s are replaced by the table and the rest of the INSERT statement
+	insertIgnore string
+
+	// the suffix of a SELECT locking the selected rows until the end of the transaction
+	forUpdate string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": &sqlDialect{
+		name:           "postgres",
+		numberedParams: true,
+		insertIgnore:   "INSERT INTO %s ON CONFLICT DO NOTHING",
+		forUpdate:      " FOR UPDATE",
+	},
+	"mysql": &sqlDialect{
+		name:         "mysql",
+		insertIgnore: "INSERT IGNORE INTO %s",
+		forUpdate:    " FOR UPDATE",
+	},
+	// sqlite is the embedded engine used for local tests
+	// sqlite locks the whole database when writing, no need to lock the rows
+	"sqlite3": &sqlDialect{
+		name:         "sqlite3",
+		insertIgnore: "INSERT OR IGNORE INTO %s",
+	},
+}
+
+// get the dialect of the given driver name
+func getSQLDialect(driver string) (*sqlDialect, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, errors.New("unsupported SQL driver: " + driver)
+	}
+	return dialect, nil
+}
+
+// rebind replaces the "?" bind parameters of the query by the ones of the dialect
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var buf []byte
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(n), 10)
+		} else {
+			buf = append(buf, query[i])
+		}
+	}
+	return string(buf)
+}
+
+// selectForUpdate builds a SELECT locking the selected rows
+func (d *sqlDialect) selectForUpdate(query string) string {
+	return d.rebind(query + d.forUpdate)
+}
+
+// insertIgnoreQuery builds an INSERT that does nothing if the row already exists,
+// insert is the part of the statement after "INSERT INTO"
+func (d *sqlDialect) insertIgnoreQuery(insert string) string {
+	return d.rebind(strings.Replace(d.insertIgnore, "%s", insert, 1))
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"database/sql"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"time"
+)
+
+// a versioned change of the schema of the SQL database
+type sqlMigration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// the migrations, in order of version. Applied migrations must never be modified:
+// to change the schema, add a new migration at the end of the list
+var sqlMigrations = []sqlMigration{
+	{
+		version:     1,
+		description: "create the links table",
+		statements: []string{
+			// the primary key on the token replaces the HSetNX lock of the redis store
+			`CREATE TABLE links (
+				token VARCHAR(64) NOT NULL PRIMARY KEY,
+				url TEXT NOT NULL,
+				creation_time BIGINT NOT NULL,
+				count BIGINT NOT NULL DEFAULT 0,
+				expiration BIGINT NOT NULL
+			)`,
+			`CREATE INDEX links_expiration ON links (expiration)`,
+		},
+	},
+	{
+		version:     2,
+		description: "add the deletion time of the links",
+		statements: []string{
+			// a deleted link is kept as a tombstone until it expires
+			`ALTER TABLE links ADD deleted_at BIGINT NULL`,
+		},
+	},
+	{
+		version:     3,
+		description: "create the table of the edits of the links",
+		statements: []string{
+			// the version is the number of the edit for the token, starting at 1
+			`CREATE TABLE link_edits (
+				token VARCHAR(64) NOT NULL,
+				version INTEGER NOT NULL,
+				url TEXT NOT NULL,
+				edit_time BIGINT NOT NULL,
+				PRIMARY KEY (token, version)
+			)`,
+		},
+	},
+	{
+		version:     4,
+		description: "add the redirect status code of the links",
+		statements: []string{
+			// 0 for the default status code
+			`ALTER TABLE links ADD redirect_status INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     5,
+		description: "create the table of the click statistics of the links",
+		statements: []string{
+			// the bucket is the unix timestamp of the start of the hour or day
+			`CREATE TABLE link_stats (
+				token VARCHAR(64) NOT NULL,
+				granularity VARCHAR(8) NOT NULL,
+				bucket BIGINT NOT NULL,
+				count BIGINT NOT NULL,
+				PRIMARY KEY (token, granularity, bucket)
+			)`,
+		},
+	},
+	{
+		version:     6,
+		description: "create the table of the click breakdowns of the links",
+		statements: []string{
+			// the longer values are truncated by the store to fit in the key
+			`CREATE TABLE link_breakdowns (
+				token VARCHAR(64) NOT NULL,
+				dimension VARCHAR(16) NOT NULL,
+				value VARCHAR(128) NOT NULL,
+				count BIGINT NOT NULL,
+				PRIMARY KEY (token, dimension, value)
+			)`,
+		},
+	},
+	{
+		version:     7,
+		description: "create the table of the sketches of the unique visitors of the links",
+		statements: []string{
+			// the registers of the HyperLogLog sketch of each link, only the non-empty ones
+			`CREATE TABLE link_visitors (
+				token VARCHAR(64) NOT NULL,
+				register_index INTEGER NOT NULL,
+				register_rank INTEGER NOT NULL,
+				PRIMARY KEY (token, register_index)
+			)`,
+		},
+	},
+	{
+		version:     8,
+		description: "add the number of redirections served to bots",
+		statements: []string{
+			`ALTER TABLE links ADD bot_count BIGINT NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version:     9,
+		description: "create the table of the API keys",
+		statements: []string{
+			// only the hash of the secret of a key is stored, the scopes are joined by commas
+			`CREATE TABLE api_keys (
+				id VARCHAR(64) NOT NULL PRIMARY KEY,
+				name TEXT NOT NULL,
+				hash VARCHAR(128) NOT NULL,
+				scopes TEXT NOT NULL,
+				creation_time BIGINT NOT NULL,
+				revoked_at BIGINT NULL
+			)`,
+		},
+	},
+	{
+		version:     10,
+		description: "add the owner of the links",
+		statements: []string{
+			// the ID of the API key which created the link, NULL if anonymous
+			`ALTER TABLE links ADD owner VARCHAR(64) NULL`,
+			// the links of an owner are listed by token
+			`CREATE INDEX links_owner ON links (owner, token)`,
+		},
+	},
+	{
+		version:     11,
+		description: "create the table of the counters of the quotas",
+		statements: []string{
+			// the counter starts again from 0 after its expiration, as a unix timestamp
+			`CREATE TABLE counters (
+				name VARCHAR(128) NOT NULL PRIMARY KEY,
+				count BIGINT NOT NULL,
+				expiration BIGINT NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     12,
+		description: "add the tenant of the API keys",
+		statements: []string{
+			// the keys issued before the tenants are the ones of the default tenant
+			`ALTER TABLE api_keys ADD tenant VARCHAR(64) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     13,
+		description: "create the table of the token buckets of the rate limits",
+		statements: []string{
+			// the time of the last use is in milliseconds, the bucket is full again after
+			// its expiration, as a unix timestamp
+			`CREATE TABLE rate_buckets (
+				name VARCHAR(128) NOT NULL PRIMARY KEY,
+				tokens DOUBLE PRECISION NOT NULL,
+				last_used BIGINT NOT NULL,
+				expiration BIGINT NOT NULL
+			)`,
+		},
+	},
+}
+
+// migrate applies the migrations that have not been applied yet to the database.
+// The applied versions are recorded in the schema_migrations table
+func migrate(db *sql.DB, dialect *sqlDialect, migrations []sqlMigration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if int64(migration.version) <= current.Int64 {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"version":     migration.version,
+			"description": migration.description}).Info("applying SQL migration")
+
+		if err := applyMigration(db, dialect, migration); err != nil {
+			log.WithError(err).WithField("version", migration.version).Error("SQL migration failed")
+			return err
+		}
+	}
+	return nil
+}
+
+// apply a migration and record its version in a single transaction, so that
+// a failed migration is not recorded (some databases, like mysql, can not roll back
+// schema changes though)
+func applyMigration(db *sql.DB, dialect *sqlDialect, migration sqlMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range migration.statements {
+		if _, err = tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(dialect.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"),
+		migration.version, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,717 @@
+package store
+
+import (
+	"database/sql"
+	log "github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the interval between two removals of the expired links from the database
+const sqlSweepInterval = time.Minute
+
+// the expiration stored for the links that never expire, so that the queries
+// on the expiration need no special case
+const sqlNeverExpires = math.MaxInt64
+
+// the tables holding the history and statistics of the links, their rows are removed
+// with the links
+var sqlLinkTables = []string{"link_edits", "link_stats", "link_breakdowns", "link_visitors"}
+
+// SQLStore stores the links in the links table of a SQL database (postgres, mysql,
+// or sqlite for local tests). The schema is created and upgraded by the migrations
+// when the store is created
+type SQLStore struct {
+	db        *sql.DB
+	dialect   *sqlDialect
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSQLStore creates a store on the database opened with the given driver and applies
+// the pending migrations. Close must be called to stop the sweeper and close the database
+func NewSQLStore(db *sql.DB, driver string) (*SQLStore, error) {
+	dialect, err := getSQLDialect(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db, dialect, sqlMigrations); err != nil {
+		return nil, err
+	}
+
+	s := &SQLStore{
+		db:      db,
+		dialect: dialect,
+		stop:    make(chan struct{}),
+	}
+	go s.sweep(sqlSweepInterval)
+	return s, nil
+}
+
+func (s *SQLStore) Reserve(token string, link Link) (bool, error) {
+	// a transaction so that the expired link is only removed if the new one is inserted
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	reserved, err := s.reserve(tx, token, link)
+	if err != nil || !reserved {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// reserve removes the expired link of the token, if any, and inserts the new link
+// in the transaction. It returns false if the token is used
+func (s *SQLStore) reserve(tx *sql.Tx, token string, link Link) (bool, error) {
+	now := time.Now().Unix()
+
+	// free the token if its link has expired but was not removed by the sweeper yet
+	result, err := tx.Exec(s.dialect.rebind("DELETE FROM links WHERE token = ? AND expiration <= ?"), token, now)
+	if err != nil {
+		return false, err
+	}
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		for _, table := range sqlLinkTables {
+			if _, err = tx.Exec(s.dialect.rebind("DELETE FROM "+table+" WHERE token = ?"), token); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	// the unique constraint on the token makes the insert fail if the token is used
+	result, err = tx.Exec(s.dialect.insertIgnoreQuery(
+		"links (token, url, creation_time, count, expiration, redirect_status, owner) VALUES (?, ?, ?, 0, ?, ?, ?)"),
+		token, link.Url, now, sqlExpiration(link.Expiration), link.RedirectStatus, sqlOwner(link.Owner))
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted == 1, err
+}
+
+func (s *SQLStore) GetRedirection(token string) (*Redirection, error) {
+	var redirection Redirection
+	err := s.db.QueryRow(s.dialect.rebind("SELECT url, redirect_status FROM links WHERE token = ? AND expiration > ? AND deleted_at IS NULL"),
+		token, time.Now().Unix()).Scan(&redirection.Url, &redirection.Status)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &redirection, nil
+}
+
+// sqlQuerier runs the queries on the database or in a transaction
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlClicks holds the increments of a batch of clicks, the existence of each token is
+// only checked once per batch
+type sqlClicks struct {
+	q       sqlQuerier
+	dialect *sqlDialect
+	found   map[string]error // the result of the existence check of each token
+}
+
+// clicks returns the increments of a batch of clicks run by the querier
+func (s *SQLStore) clicks(q sqlQuerier) *sqlClicks {
+	return &sqlClicks{q: q, dialect: s.dialect, found: map[string]error{}}
+}
+
+func (c *sqlClicks) incrementCount(token string) (int64, error) {
+	return c.incrementLinkCount(token, "count")
+}
+
+func (c *sqlClicks) incrementBotCount(token string) (int64, error) {
+	return c.incrementLinkCount(token, "bot_count")
+}
+
+// incrementLinkCount increments the count column of the link and returns its new value
+func (c *sqlClicks) incrementLinkCount(token string, column string) (int64, error) {
+	// atomic increment in the database, no read-modify-write
+	result, err := c.q.Exec(c.dialect.rebind("UPDATE links SET "+column+" = "+column+" + 1 WHERE token = ? AND expiration > ? AND deleted_at IS NULL"),
+		token, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if updated == 0 {
+		c.found[token] = ErrNotFound
+		return 0, ErrNotFound
+	}
+	c.found[token] = nil
+
+	var count int64
+	err = c.q.QueryRow(c.dialect.rebind("SELECT "+column+" FROM links WHERE token = ?"), token).Scan(&count)
+	if err == sql.ErrNoRows {
+		// deleted in the meantime
+		return 0, ErrNotFound
+	}
+	return count, err
+}
+
+func (c *sqlClicks) incrementStats(token string, granularity Granularity, t time.Time, retention time.Duration) error {
+	if err := c.exists(token); err != nil {
+		return err
+	}
+
+	start := granularity.BucketStart(t).Unix()
+	created, err := c.incrementCounter("link_stats", []string{"token", "granularity", "bucket"}, token, string(granularity), start)
+	if err != nil || !created {
+		return err
+	}
+	// first click of the bucket: remove the buckets older than the retention
+	_, err = c.q.Exec(c.dialect.rebind("DELETE FROM link_stats WHERE token = ? AND granularity = ? AND bucket < ?"),
+		token, string(granularity), start-int64(retention/time.Second))
+	return err
+}
+
+// incrementCounter increments the count of the row of the table with the given values
+// of the key columns, the row is created if needed. It returns true if the row was created
+func (c *sqlClicks) incrementCounter(table string, columns []string, key ...interface{}) (bool, error) {
+	where := strings.Join(columns, " = ? AND ") + " = ?"
+	update := c.dialect.rebind("UPDATE " + table + " SET count = count + 1 WHERE " + where)
+	result, err := c.q.Exec(update, key...)
+	if err != nil {
+		return false, err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 1 {
+		return false, err
+	}
+
+	result, err = c.q.Exec(c.dialect.insertIgnoreQuery(table+" ("+strings.Join(columns, ", ")+", count) VALUES ("+
+		strings.Repeat("?, ", len(columns))+"1)"), key...)
+	if err != nil {
+		return false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 1 {
+		return inserted == 1, err
+	}
+	// created concurrently in the meantime
+	_, err = c.q.Exec(update, key...)
+	return false, err
+}
+
+func (c *sqlClicks) incrementBreakdowns(token string, values map[Dimension]string) error {
+	if err := c.exists(token); err != nil {
+		return err
+	}
+	for dimension, value := range values {
+		_, err := c.incrementCounter("link_breakdowns", []string{"token", "dimension", "value"}, token, string(dimension), breakdownValue(value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sqlClicks) addVisitor(token string, fingerprint string) error {
+	if err := c.exists(token); err != nil {
+		return err
+	}
+
+	// the rank of a register is only raised: the concurrent additions need no lock
+	register, rank := hllPosition(fingerprint)
+	result, err := c.q.Exec(c.dialect.insertIgnoreQuery("link_visitors (token, register_index, register_rank) VALUES (?, ?, ?)"),
+		token, register, rank)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 1 {
+		return err
+	}
+	_, err = c.q.Exec(c.dialect.rebind(
+		"UPDATE link_visitors SET register_rank = ? WHERE token = ? AND register_index = ? AND register_rank < ?"),
+		rank, token, register, rank)
+	return err
+}
+
+// exists returns ErrNotFound if the token has no link, the result is kept for the batch
+func (c *sqlClicks) exists(token string) error {
+	if err, ok := c.found[token]; ok {
+		return err
+	}
+	err := existsIn(c.q, c.dialect, token)
+	if err == nil || err == ErrNotFound {
+		c.found[token] = err
+	}
+	return err
+}
+
+func (s *SQLStore) GetStats(token string, granularity Granularity, from, to time.Time) ([]StatsBucket, error) {
+	if err := s.exists(token); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT bucket, count FROM link_stats
+		WHERE token = ? AND granularity = ? AND bucket >= ? AND bucket <= ? ORDER BY bucket`),
+		token, string(granularity), from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buckets []StatsBucket
+	for rows.Next() {
+		var bucket StatsBucket
+		if err := rows.Scan(&bucket.Start, &bucket.Count); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *SQLStore) GetBreakdown(token string, dimension Dimension, n int) ([]BreakdownEntry, error) {
+	if err := s.exists(token); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT value, count FROM link_breakdowns
+		WHERE token = ? AND dimension = ? ORDER BY count DESC, value LIMIT ?`), token, string(dimension), n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []BreakdownEntry{}
+	for rows.Next() {
+		var entry BreakdownEntry
+		if err := rows.Scan(&entry.Value, &entry.Count); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLStore) CountVisitors(token string) (int64, error) {
+	if err := s.exists(token); err != nil {
+		return 0, err
+	}
+
+	rows, err := s.db.Query(s.dialect.rebind("SELECT register_index, register_rank FROM link_visitors WHERE token = ?"), token)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	visitors := newHyperLogLog()
+	for rows.Next() {
+		var register int
+		var rank uint8
+		if err := rows.Scan(&register, &rank); err != nil {
+			return 0, err
+		}
+		visitors.set(register, rank)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return visitors.count(), nil
+}
+
+func (s *SQLStore) RecordClicks(clicks []Click, retention map[Granularity]time.Duration) error {
+	// a single transaction for the batch instead of one per increment
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect once committed
+
+	if err := recordClicks(s.clicks(tx), clicks, retention); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// exists returns ErrNotFound if the token has no link
+func (s *SQLStore) exists(token string) error {
+	return existsIn(s.db, s.dialect, token)
+}
+
+// existsIn returns ErrNotFound if the token has no link, the query is run by the querier
+func existsIn(q sqlQuerier, dialect *sqlDialect, token string) error {
+	var found int
+	err := q.QueryRow(dialect.rebind("SELECT 1 FROM links WHERE token = ? AND expiration > ? AND deleted_at IS NULL"),
+		token, time.Now().Unix()).Scan(&found)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *SQLStore) GetLink(token string) (*Link, error) {
+	link, err := scanLink(s.db.QueryRow(s.dialect.rebind(`SELECT url, creation_time, count, bot_count, expiration, redirect_status, owner
+		FROM links WHERE token = ? AND expiration > ? AND deleted_at IS NULL`), token, time.Now().Unix()))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(s.dialect.rebind("SELECT url, edit_time FROM link_edits WHERE token = ? ORDER BY version"), token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var edit Edit
+		if err := rows.Scan(&edit.Url, &edit.EditTime); err != nil {
+			return nil, err
+		}
+		link.History = append(link.History, edit)
+	}
+	return link, rows.Err()
+}
+
+func (s *SQLStore) ListLinks(owner string, cursor string, n int) ([]OwnedLink, string, error) {
+	// one more link to know if there are links after the page
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT token, url, creation_time, count, bot_count, expiration, redirect_status, owner
+		FROM links WHERE owner = ? AND token > ? AND expiration > ? AND deleted_at IS NULL ORDER BY token LIMIT ?`),
+		owner, cursor, time.Now().Unix(), n+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	links := []OwnedLink{}
+	for rows.Next() {
+		var token string
+		link, err := scanLink(rows, &token)
+		if err != nil {
+			return nil, "", err
+		}
+		links = append(links, OwnedLink{Token: token, Link: *link})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	links, next := pageLinks(links, cursor, n)
+	return links, next, nil
+}
+
+func (s *SQLStore) UpdateUrl(token string, url string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect once committed
+
+	// lock the link so that the concurrent updates are recorded one after the other
+	now := time.Now().Unix()
+	var previous string
+	err = tx.QueryRow(s.dialect.selectForUpdate("SELECT url FROM links WHERE token = ? AND expiration > ? AND deleted_at IS NULL"),
+		token, now).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.dialect.rebind(`INSERT INTO link_edits (token, version, url, edit_time)
+		SELECT ?, COUNT(*) + 1, ?, ? FROM link_edits WHERE token = ?`), token, previous, now, token)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(s.dialect.rebind("UPDATE links SET url = ? WHERE token = ?"), url, token); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Delete(token string) error {
+	// a transaction so that the statistics are only removed with the link
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect once committed
+
+	// keep the row as a tombstone until it expires so that the token is not re-issued
+	now := time.Now().Unix()
+	result, err := tx.Exec(s.dialect.rebind("UPDATE links SET deleted_at = ? WHERE token = ? AND expiration > ? AND deleted_at IS NULL"),
+		now, token, now)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrNotFound
+	}
+	// the tombstone has no history nor statistics
+	for _, table := range sqlLinkTables {
+		if _, err = tx.Exec(s.dialect.rebind("DELETE FROM "+table+" WHERE token = ?"), token); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) AddKey(key APIKey) error {
+	// the primary key on the ID makes the insert fail if the key exists
+	result, err := s.db.Exec(s.dialect.insertIgnoreQuery(
+		"api_keys (id, name, tenant, hash, scopes, creation_time) VALUES (?, ?, ?, ?, ?, ?)"),
+		key.ID, key.Name, key.Tenant, key.Hash, joinScopes(key.Scopes), key.CreationTime)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func (s *SQLStore) GetKey(id string) (*APIKey, error) {
+	key, err := scanKey(s.db.QueryRow(s.dialect.rebind(
+		"SELECT id, name, tenant, hash, scopes, creation_time, revoked_at FROM api_keys WHERE id = ?"), id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *SQLStore) ListKeys() ([]APIKey, error) {
+	rows, err := s.db.Query("SELECT id, name, tenant, hash, scopes, creation_time, revoked_at FROM api_keys ORDER BY creation_time, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) RevokeKey(id string) error {
+	// the revocation time of a revoked key is kept
+	result, err := s.db.Exec(s.dialect.rebind("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL"),
+		time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if revoked, err := result.RowsAffected(); err != nil || revoked > 0 {
+		return err
+	}
+	// nothing updated: the key is missing or already revoked
+	_, err = s.GetKey(id)
+	return err
+}
+
+// IncrementCounter increments the counter in the counters table, in a transaction locking
+// its row. The expired counter starts again from 0 with the new expiration
+func (s *SQLStore) IncrementCounter(name string, expiration time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no effect once committed
+
+	// lock the counter so that the concurrent increments are not lost when it expires
+	var count, end int64
+	err = tx.QueryRow(s.dialect.selectForUpdate("SELECT count, expiration FROM counters WHERE name = ?"), name).Scan(&count, &end)
+	switch {
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(s.dialect.insertIgnoreQuery("counters (name, count, expiration) VALUES (?, 1, ?)"),
+			name, expiration.Unix())
+		if err != nil {
+			return 0, err
+		}
+		if inserted, err := result.RowsAffected(); err != nil {
+			return 0, err
+		} else if inserted == 0 {
+			// created concurrently in the meantime, increment it instead
+			tx.Rollback()
+			return s.IncrementCounter(name, expiration)
+		}
+		return 1, tx.Commit()
+	case err != nil:
+		return 0, err
+	case end <= time.Now().Unix():
+		// expired: start again from 1
+		_, err = tx.Exec(s.dialect.rebind("UPDATE counters SET count = 1, expiration = ? WHERE name = ?"), expiration.Unix(), name)
+		count = 1
+	default:
+		_, err = tx.Exec(s.dialect.rebind("UPDATE counters SET count = count + 1 WHERE name = ?"), name)
+		count++
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+func (s *SQLStore) DecrementCounter(name string) error {
+	// the expired counter is left as is, the next increment starts it again from 1
+	_, err := s.db.Exec(s.dialect.rebind("UPDATE counters SET count = count - 1 WHERE name = ? AND expiration > ? AND count > 0"),
+		name, time.Now().Unix())
+	return err
+}
+
+// TakeToken takes a token from the bucket in the rate_buckets table, in a transaction
+// locking its row
+func (s *SQLStore) TakeToken(name string, capacity int, period time.Duration) (bool, time.Duration, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback() // no effect once committed
+
+	now := time.Now()
+	var tokens float64
+	var lastUsed int64
+	err = tx.QueryRow(s.dialect.selectForUpdate("SELECT tokens, last_used FROM rate_buckets WHERE name = ?"), name).Scan(&tokens, &lastUsed)
+	if err == sql.ErrNoRows {
+		bucket := NewTokenBucket(capacity, now)
+		taken, wait := bucket.Take(capacity, period, now)
+		result, err := tx.Exec(s.dialect.insertIgnoreQuery("rate_buckets (name, tokens, last_used, expiration) VALUES (?, ?, ?, ?)"),
+			name, bucket.Tokens, unixMillis(now), now.Add(period).Unix())
+		if err != nil {
+			return false, 0, err
+		}
+		if inserted, err := result.RowsAffected(); err != nil {
+			return false, 0, err
+		} else if inserted == 0 {
+			// created concurrently in the meantime, take the token from it instead
+			tx.Rollback()
+			return s.TakeToken(name, capacity, period)
+		}
+		return taken, wait, tx.Commit()
+	} else if err != nil {
+		return false, 0, err
+	}
+
+	bucket := TokenBucket{Tokens: tokens, LastUsed: time.Unix(0, lastUsed*int64(time.Millisecond))}
+	taken, wait := bucket.Take(capacity, period, now)
+	// the bucket is full again once unused for a period, it is then removed by the sweeper
+	_, err = tx.Exec(s.dialect.rebind("UPDATE rate_buckets SET tokens = ?, last_used = ?, expiration = ? WHERE name = ?"),
+		bucket.Tokens, unixMillis(bucket.LastUsed), bucket.LastUsed.Add(period).Unix(), name)
+	if err != nil {
+		return false, 0, err
+	}
+	return taken, wait, tx.Commit()
+}
+
+// Ping checks the connection to the database
+func (s *SQLStore) Ping() error {
+	return s.db.Ping()
+}
+
+// Close stops the sweeper and closes the database, the next calls have no effect
+func (s *SQLStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		err = s.db.Close()
+	})
+	return err
+}
+
+// scanLink reads a link from a row of the links table: the columns given as dest, then
+// the url, creation time, counts, expiration, redirect status and owner
+func scanLink(row interface {
+	Scan(dest ...interface{}) error
+}, dest ...interface{}) (*Link, error) {
+	var link Link
+	var owner sql.NullString
+	dest = append(dest, &link.Url, &link.CreationTime, &link.Count, &link.BotCount, &link.Expiration, &link.RedirectStatus, &owner)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if link.Expiration == sqlNeverExpires {
+		link.Expiration = 0
+	}
+	link.Owner = owner.String
+	return &link, nil
+}
+
+// scanKey reads an API key from a row of the api_keys table
+func scanKey(row interface {
+	Scan(dest ...interface{}) error
+}) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var revokedAt sql.NullInt64
+	if err := row.Scan(&key.ID, &key.Name, &key.Tenant, &key.Hash, &scopes, &key.CreationTime, &revokedAt); err != nil {
+		return nil, err
+	}
+	key.Scopes = splitScopes(scopes)
+	key.RevokedTime = revokedAt.Int64
+	return &key, nil
+}
+
+// sweep periodically removes the expired links from the database
+func (s *SQLStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			var err error
+			for _, table := range sqlLinkTables {
+				_, err = s.db.Exec(s.dialect.rebind(
+					"DELETE FROM "+table+" WHERE token IN (SELECT token FROM links WHERE expiration <= ?)"), now.Unix())
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				log.WithError(err).Error("could not remove the history and statistics of the expired links from the database")
+				continue
+			}
+			result, err := s.db.Exec(s.dialect.rebind("DELETE FROM links WHERE expiration <= ?"), now.Unix())
+			if err != nil {
+				log.WithError(err).Error("could not remove the expired links from the database")
+				continue
+			}
+			removed, _ := result.RowsAffected()
+			log.WithField("removed", removed).Debug("expired links removed from the database")
+			if _, err = s.db.Exec(s.dialect.rebind("DELETE FROM counters WHERE expiration <= ?"), now.Unix()); err != nil {
+				log.WithError(err).Error("could not remove the expired counters from the database")
+			}
+			if _, err = s.db.Exec(s.dialect.rebind("DELETE FROM rate_buckets WHERE expiration <= ?"), now.Unix()); err != nil {
+				log.WithError(err).Error("could not remove the full buckets of the rate limits from the database")
+			}
+		}
+	}
+}
+
+// the time as a unix timestamp in milliseconds
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// the expiration to store for the expiration of a link, 0 never expires
+func sqlExpiration(expiration int64) int64 {
+	if expiration == 0 {
+		return sqlNeverExpires
+	}
+	return expiration
+}
+
+// the owner stored for a link, NULL for the anonymous links
+func sqlOwner(owner string) interface{} {
+	if owner == "" {
+		return nil
+	}
+	return owner
+}
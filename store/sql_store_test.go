@@ -0,0 +1,380 @@
+package store
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The SQL store is tested against the database given by the SQL_TEST_DRIVER and
+// SQL_TEST_DSN environment variables. By default the embedded sqlite engine is used
+// when the driver is linked in the tests: go test -tags sqlite ./store
+func openTestSQLStore(t *testing.T) (*SQLStore, func()) {
+	driver := os.Getenv("SQL_TEST_DRIVER")
+	dsn := os.Getenv("SQL_TEST_DSN")
+	cleanup := func() {}
+	if driver == "" {
+		driver = "sqlite3"
+		path, remove := tempStorePath(t)
+		dsn, cleanup = path, remove
+	}
+
+	registered := false
+	for _, d := range sql.Drivers() {
+		registered = registered || d == driver
+	}
+	if !registered {
+		cleanup()
+		t.Skip("SQL driver " + driver + " not linked in the tests")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	s, err := NewSQLStore(db, driver)
+	if err != nil {
+		cleanup()
+		t.Fatal("Could not create the store:", err)
+	}
+	return s, func() {
+		// every table created by the migrations, so that the next test starts from an empty database
+		tables := []string{"links", "link_edits", "link_stats", "link_breakdowns", "link_visitors", "api_keys",
+			"counters", "rate_buckets", "schema_migrations"}
+		for _, table := range tables {
+			s.db.Exec("DROP TABLE " + table)
+		}
+		s.Close()
+		cleanup()
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	expiration := time.Now().Add(time.Hour)
+	if ok, err := s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: expiration.Unix()}); !ok || err != nil {
+		t.Fatal("Could not reserve a free token:", err)
+	}
+	if ok, err := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: expiration.Unix()}); ok || err != nil {
+		t.Error("Reserved an already used token, error:", err)
+	}
+
+	s.clicks(s.db).incrementCount("abc123")
+	if count, err := s.clicks(s.db).incrementCount("abc123"); count != 2 || err != nil {
+		t.Error("Wrong count: got", count, err)
+	}
+	if count, err := s.clicks(s.db).incrementBotCount("abc123"); count != 1 || err != nil {
+		t.Error("Wrong bot count: got", count, err)
+	}
+	link, err := s.GetLink("abc123")
+	if err != nil || link.Url != "http://google.com/" || link.Count != 2 || link.BotCount != 1 {
+		t.Error("Wrong link: got", link, err)
+	}
+
+	if err := s.UpdateUrl("abc123", "http://example.com/"); err != nil {
+		t.Error("Could not update the url:", err)
+	}
+	s.UpdateUrl("abc123", "http://example.org/")
+	link, err = s.GetLink("abc123")
+	if err != nil || link.Url != "http://example.org/" || link.Count != 2 {
+		t.Error("Wrong link after update: got", link, err)
+	} else if len(link.History) != 2 || link.History[0].Url != "http://google.com/" || link.History[1].Url != "http://example.com/" {
+		t.Error("Wrong history: got", link.History)
+	}
+	if err := s.UpdateUrl("zzz999", "http://example.com/"); err != ErrNotFound {
+		t.Error("Updated a missing token, error:", err)
+	}
+
+	if err := s.Delete("abc123"); err != nil {
+		t.Error("Could not delete the token:", err)
+	}
+	if _, err := s.GetRedirection("abc123"); err != ErrNotFound {
+		t.Error("Deleted token found, error:", err)
+	}
+	if err := s.Delete("abc123"); err != ErrNotFound {
+		t.Error("Deleted a deleted token, error:", err)
+	}
+	if ok, _ := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: expiration.Unix()}); ok {
+		t.Error("Deleted token re-issued")
+	}
+	if _, err := s.clicks(s.db).incrementCount("abc123"); err != ErrNotFound {
+		t.Error("Incremented the count of a missing token, error:", err)
+	}
+}
+
+func TestSQLStoreExpiration(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(-time.Second).Unix()})
+	if _, err := s.GetLink("abc123"); err != ErrNotFound {
+		t.Error("Expired link still returned, error:", err)
+	}
+	if ok, err := s.Reserve("abc123", Link{Url: "http://example.com/", Expiration: time.Now().Add(time.Hour).Unix()}); !ok || err != nil {
+		t.Error("Could not reserve an expired token:", err)
+	}
+
+	s.Reserve("perm", Link{Url: "http://google.com/", RedirectStatus: 302})
+	if link, err := s.GetLink("perm"); err != nil || link.Expiration != 0 || link.RedirectStatus != 302 {
+		t.Error("Wrong permanent link: got", link, err)
+	}
+	if redirection, err := s.GetRedirection("perm"); err != nil || redirection.Status != 302 {
+		t.Error("Wrong redirection: got", redirection, err)
+	}
+}
+
+func TestSQLStoreAtomicReserve(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(-time.Second).Unix()})
+	if _, err := s.db.Exec(s.dialect.rebind("INSERT INTO link_stats (token, granularity, bucket, count) VALUES (?, 'hour', 0, 1)"), "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	// the removal of the statistics of the expired link fails after the link was removed
+	if _, err := s.db.Exec("DROP TABLE link_visitors"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Reserve("abc123", Link{Url: "http://example.com/"}); ok || err == nil {
+		t.Error("Token reserved despite the failure: got", ok, err)
+	}
+
+	// the transaction is rolled back: the expired link and its statistics are kept
+	var url string
+	if err := s.db.QueryRow(s.dialect.rebind("SELECT url FROM links WHERE token = ?"), "abc123").Scan(&url); err != nil || url != "http://google.com/" {
+		t.Error("Expired link not restored: got", url, err)
+	}
+	var count int
+	s.db.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM link_stats WHERE token = ?"), "abc123").Scan(&count)
+	if count != 1 {
+		t.Error("Statistics not restored: got", count)
+	}
+}
+
+func TestSQLStoreAtomicDelete(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	s.clicks(s.db).incrementStats("abc123", Hourly, time.Now(), time.Hour)
+	// the removal of the statistics fails after the tombstone was written
+	if _, err := s.db.Exec("DROP TABLE link_visitors"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("abc123"); err == nil {
+		t.Error("Token deleted despite the failure")
+	}
+
+	// the transaction is rolled back: the link and its statistics are kept
+	if _, err := s.GetLink("abc123"); err != nil {
+		t.Error("Link not restored:", err)
+	}
+	if buckets, _ := s.GetStats("abc123", Hourly, time.Now().Add(-time.Hour), time.Now()); len(buckets) != 1 {
+		t.Error("Statistics not restored: got", buckets)
+	}
+}
+
+func TestSQLStoreClose(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	// the cleanup closes the store a first time
+	cleanup()
+	if err := s.Close(); err != nil {
+		t.Error("Could not close the store twice:", err)
+	}
+}
+
+func TestSQLStoreStats(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	if err := s.clicks(s.db).incrementStats("abc123", Hourly, now, time.Hour); err != ErrNotFound {
+		t.Error("Incremented the stats of a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: now.Add(time.Hour).Unix()})
+	old := now.Add(-3 * time.Hour)
+	s.clicks(s.db).incrementStats("abc123", Hourly, old, 24*time.Hour)
+	s.clicks(s.db).incrementStats("abc123", Hourly, now, 24*time.Hour)
+	if err := s.clicks(s.db).incrementStats("abc123", Hourly, now, 24*time.Hour); err != nil {
+		t.Error("Could not increment the stats:", err)
+	}
+	buckets, err := s.GetStats("abc123", Hourly, old.Add(-time.Hour), now)
+	if err != nil || len(buckets) != 2 || buckets[0].Count != 1 || buckets[1].Count != 2 ||
+		buckets[1].Start != Hourly.BucketStart(now).Unix() {
+		t.Error("Wrong buckets: got", buckets, err)
+	}
+
+	// the buckets older than the retention are removed with the next new bucket
+	s.clicks(s.db).incrementStats("abc123", Hourly, now.Add(time.Hour), time.Hour)
+	if buckets, _ := s.GetStats("abc123", Hourly, old.Add(-time.Hour), now.Add(time.Hour)); len(buckets) != 2 {
+		t.Error("Buckets older than the retention kept: got", buckets)
+	}
+
+	s.Delete("abc123")
+	if _, err := s.GetStats("abc123", Hourly, old.Add(-time.Hour), now); err != ErrNotFound {
+		t.Error("Stats of a deleted token returned, error:", err)
+	}
+}
+
+func TestSQLStoreBreakdowns(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	if err := s.clicks(s.db).incrementBreakdowns("abc123", map[Dimension]string{Browser: "Firefox"}); err != ErrNotFound {
+		t.Error("Incremented the breakdowns of a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	for _, referrer := range []string{"t.co", "google.com", "t.co", "direct", "t.co", "google.com"} {
+		if err := s.clicks(s.db).incrementBreakdowns("abc123", map[Dimension]string{Referrer: referrer, Browser: "Firefox"}); err != nil {
+			t.Fatal("Could not increment the breakdowns:", err)
+		}
+	}
+	entries, err := s.GetBreakdown("abc123", Referrer, 2)
+	if err != nil || len(entries) != 2 || entries[0] != (BreakdownEntry{"t.co", 3}) || entries[1] != (BreakdownEntry{"google.com", 2}) {
+		t.Error("Wrong referrers: got", entries, err)
+	}
+	if entries, _ := s.GetBreakdown("abc123", Browser, 10); len(entries) != 1 || entries[0] != (BreakdownEntry{"Firefox", 6}) {
+		t.Error("Wrong browsers: got", entries)
+	}
+	if entries, err := s.GetBreakdown("abc123", Country, 10); err != nil || len(entries) != 0 {
+		t.Error("Wrong empty breakdown: got", entries, err)
+	}
+
+	s.Delete("abc123")
+	if _, err := s.GetBreakdown("abc123", Referrer, 10); err != ErrNotFound {
+		t.Error("Breakdowns of a deleted token returned, error:", err)
+	}
+}
+
+func TestSQLStoreVisitors(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	if err := s.clicks(s.db).addVisitor("abc123", "visitor"); err != ErrNotFound {
+		t.Error("Added a visitor to a missing token, error:", err)
+	}
+
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+	if count, err := s.CountVisitors("abc123"); count != 0 || err != nil {
+		t.Error("Wrong count without visitors: got", count, err)
+	}
+	for i := 0; i < 100; i++ {
+		// each visitor comes twice
+		s.clicks(s.db).addVisitor("abc123", "visitor"+strconv.Itoa(i%50))
+	}
+	if count, err := s.CountVisitors("abc123"); count < 48 || count > 52 || err != nil {
+		t.Error("Wrong count of unique visitors: got", count, err)
+	}
+
+	s.Delete("abc123")
+	if _, err := s.CountVisitors("abc123"); err != ErrNotFound {
+		t.Error("Visitors of a deleted token counted, error:", err)
+	}
+}
+
+func TestSQLStoreRecordClicks(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+	s.Reserve("abc123", Link{Url: "http://google.com/", Expiration: time.Now().Add(time.Hour).Unix()})
+
+	now := time.Now()
+	human := Click{Token: "abc123", Time: now, Breakdowns: map[Dimension]string{Browser: "Firefox"}, Fingerprint: "visitor"}
+	clicks := []Click{
+		human,
+		human,
+		{Token: "abc123", Time: now, Bot: true},
+		// the clicks of the missing links are ignored
+		{Token: "zzz999", Time: now},
+	}
+	retention := map[Granularity]time.Duration{Hourly: time.Hour, Daily: 24 * time.Hour}
+	if err := s.RecordClicks(clicks, retention); err != nil {
+		t.Fatal("Could not record the clicks:", err)
+	}
+
+	link, _ := s.GetLink("abc123")
+	if link.Count != 2 || link.BotCount != 1 {
+		t.Error("Wrong counts: got", link.Count, link.BotCount)
+	}
+	if buckets, _ := s.GetStats("abc123", Daily, now.Add(-24*time.Hour), now); len(buckets) != 1 || buckets[0].Count != 2 {
+		t.Error("Wrong stats: got", buckets)
+	}
+	if entries, _ := s.GetBreakdown("abc123", Browser, 10); len(entries) != 1 || entries[0] != (BreakdownEntry{"Firefox", 2}) {
+		t.Error("Wrong breakdown: got", entries)
+	}
+
+	// the batch is recorded in a transaction: nothing is recorded if a click fails
+	if _, err := s.db.Exec("DROP TABLE link_visitors"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordClicks(clicks, retention); err == nil {
+		t.Error("Clicks recorded despite the failure")
+	}
+	if link, _ := s.GetLink("abc123"); link.Count != 2 || link.BotCount != 1 {
+		t.Error("Counts not rolled back: got", link.Count, link.BotCount)
+	}
+}
+
+func TestSQLStoreKeys(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	testKeys(t, s)
+}
+
+func TestSQLStoreListLinks(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	testListLinks(t, s)
+}
+
+func TestSQLStoreCounter(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	testCounter(t, s)
+}
+
+func TestSQLStoreTakeToken(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	testTakeToken(t, s)
+}
+
+func TestSQLMigrations(t *testing.T) {
+	s, cleanup := openTestSQLStore(t)
+	defer cleanup()
+
+	// migrating again does nothing
+	if err := migrate(s.db, s.dialect, sqlMigrations); err != nil {
+		t.Error("Could not re-run the migrations:", err)
+	}
+	var version int
+	s.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if version != sqlMigrations[len(sqlMigrations)-1].version {
+		t.Error("Wrong schema version: got", version)
+	}
+}
+
+func TestSQLRebind(t *testing.T) {
+	postgres, _ := getSQLDialect("postgres")
+	query := "UPDATE links SET url = ? WHERE token = ?"
+	if got := postgres.rebind(query); got != "UPDATE links SET url = $1 WHERE token = $2" {
+		t.Error("Wrong postgres query: got", got)
+	}
+	mysql, _ := getSQLDialect("mysql")
+	if got := mysql.rebind(query); got != query {
+		t.Error("Wrong mysql query: got", got)
+	}
+	if _, err := getSQLDialect("oracle"); err == nil {
+		t.Error("Unsupported driver accepted")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package store
+
+// link the embedded sqlite engine to run the SQL store tests locally
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Granularity is the duration covered by the buckets of the click statistics
+type Granularity string
+
+const (
+	Hourly Granularity = "hour" // one bucket per hour
+	Daily  Granularity = "day"  // one bucket per day, in UTC
+)
+
+// Granularities lists the granularities of the statistics recorded for each click
+var Granularities = []Granularity{Hourly, Daily}
+
+// ErrInvalidGranularity is returned for a granularity which is neither Hourly nor Daily
+var ErrInvalidGranularity = errors.New("invalid granularity")
+
+// ParseGranularity returns the granularity of the given name ("hour" or "day")
+func ParseGranularity(name string) (Granularity, error) {
+	for _, g := range Granularities {
+		if string(g) == name {
+			return g, nil
+		}
+	}
+	return "", ErrInvalidGranularity
+}
+
+// Duration returns the duration covered by a bucket
+func (g Granularity) Duration() time.Duration {
+	if g == Daily {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+// BucketStart returns the start of the bucket containing the time
+func (g Granularity) BucketStart(t time.Time) time.Time {
+	// the unix time has no leap seconds: truncating it gives the UTC hours and days
+	return t.UTC().Truncate(g.Duration())
+}
+
+// StatsBucket holds the number of clicks on a link during an hour or a day
+type StatsBucket struct {
+	Start int64 // the start of the bucket, as a unix timestamp in seconds
+	Count int64 // the number of clicks during the bucket
+}
+
+// filterBuckets returns the buckets starting between from and to (included),
+// sorted by start
+func filterBuckets(buckets map[int64]int64, from, to time.Time) []StatsBucket {
+	var filtered []StatsBucket
+	for start, count := range buckets {
+		if start >= from.Unix() && start <= to.Unix() {
+			filtered = append(filtered, StatsBucket{Start: start, Count: count})
+		}
+	}
+	sortBuckets(filtered)
+	return filtered
+}
+
+func sortBuckets(buckets []StatsBucket) {
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start < buckets[j].Start })
+}
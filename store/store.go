@@ -0,0 +1,154 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrNotFound is returned when the requested token does not exist in the store
+var ErrNotFound = errors.New("token not found")
+
+// Link holds the information stored for a short link
+type Link struct {
+	Url            string `json:"url"`            // the long url the token redirects to
+	CreationTime   int64  `json:"creationTime"`   // the creation time, as a unix timestamp in seconds
+	Count          int64  `json:"count"`          // the number of redirections served for this token to humans
+	BotCount       int64  `json:"botCount"`       // the number of redirections served to bots
+	Expiration     int64  `json:"expiration"`     // the expiration time as a unix timestamp, 0 if it never expires
+	RedirectStatus int    `json:"redirectStatus"` // the status code of the redirections, 0 for the default one
+	Owner          string `json:"owner"`          // the ID of the API key which created the link, empty if anonymous
+	History        []Edit `json:"history"`        // the previous urls of the link, oldest first
+}
+
+// OwnedLink is a link listed with its token
+type OwnedLink struct {
+	Token string `json:"token"`
+	Link
+}
+
+// Redirection holds what is needed to redirect to the url of a link
+type Redirection struct {
+	Url    string // the long url the token redirects to
+	Status int    // the status code of the redirection, 0 for the default one
+}
+
+// Edit records a change of the url of a link
+type Edit struct {
+	Url      string `json:"url"`      // the url before the change
+	EditTime int64  `json:"editTime"` // the time of the change, as a unix timestamp in seconds
+}
+
+// LinkStore is the interface implemented by the storage backends.
+// The handlers only depend on this interface so that the backend can be changed
+// without touching the handlers' code
+type LinkStore interface {
+	// Reserve tries to acquire the token for the given link. It returns false if the
+	// token is already used. The creation time and counts of the link are set by the
+	// store, its history is ignored. The link is listed with the links of its owner
+	Reserve(token string, link Link) (bool, error)
+
+	// GetRedirection returns the url and status code to redirect to for the token,
+	// or ErrNotFound
+	GetRedirection(token string) (*Redirection, error)
+
+	// GetStats returns the non-empty buckets of the given granularity starting between
+	// from and to, sorted by start. ErrNotFound is returned if the token does not exist
+	GetStats(token string, granularity Granularity, from, to time.Time) ([]StatsBucket, error)
+
+	// GetBreakdown returns the n values of the dimension with the most clicks, by
+	// decreasing count. ErrNotFound is returned if the token does not exist
+	GetBreakdown(token string, dimension Dimension, n int) ([]BreakdownEntry, error)
+
+	// CountVisitors returns the estimated number of unique visitors of the link, or
+	// ErrNotFound
+	CountVisitors(token string) (int64, error)
+
+	// RecordClicks records a batch of clicks in the counts, statistics, breakdowns and
+	// unique visitors of their links, in as few round-trips as the backend allows.
+	// The statistics are kept for the retention of their granularity. The clicks of
+	// the missing links are ignored
+	RecordClicks(clicks []Click, retention map[Granularity]time.Duration) error
+
+	// UpdateUrl replaces the url of the link, keeping its creation time and counts.
+	// The previous url is recorded in the history of the link. ErrNotFound is returned
+	// if the token does not exist
+	UpdateUrl(token string, url string) error
+
+	// GetLink returns all the information stored for the token, or ErrNotFound
+	GetLink(token string) (*Link, error)
+
+	// ListLinks returns, by token, at most n links of the owner whose token comes after
+	// the cursor, without their history. The returned cursor gives the next links, it is
+	// empty once all the links are listed
+	ListLinks(owner string, cursor string, n int) ([]OwnedLink, string, error)
+
+	// Delete removes the link of the token with its statistics and breakdowns,
+	// ErrNotFound is returned if it did not exist. A tombstone keeps the token used
+	// until the link would have expired, so that the token is not re-issued for
+	// another url
+	Delete(token string) error
+
+	// AddKey stores a new API key, ErrKeyExists is returned if its ID is used
+	AddKey(key APIKey) error
+
+	// GetKey returns the API key of the ID, revoked or not, or ErrNotFound
+	GetKey(id string) (*APIKey, error)
+
+	// ListKeys returns all the API keys, revoked or not, by creation time
+	ListKeys() ([]APIKey, error)
+
+	// RevokeKey marks the API key as revoked so that it can not be used anymore,
+	// ErrNotFound is returned if it does not exist
+	RevokeKey(id string) error
+
+	// IncrementCounter increments the counter of the name and returns its new value. The
+	// counter is created with the expiration, after which it starts again from 0. The
+	// counters are shared by the servers using the same backend, for their quotas
+	IncrementCounter(name string, expiration time.Time) (int64, error)
+
+	// DecrementCounter gives back an increment of the counter of the name, if it has not
+	// expired. The counter does not go below 0
+	DecrementCounter(name string) error
+
+	// TakeToken takes a token from the bucket of the name, which holds up to capacity tokens
+	// and is refilled continuously with capacity tokens per period. If the bucket holds less
+	// than a token, false is returned with the time until it holds one. The buckets are
+	// shared by the servers using the same backend, for their rate limits
+	TakeToken(name string, capacity int, period time.Duration) (bool, time.Duration, error)
+
+	// Ping checks that the backend of the store can be reached
+	Ping() error
+
+	// Close releases the resources used by the store
+	Close() error
+}
+
+// UnixOrZero returns the unix timestamp of the time, or 0 for the zero time
+func UnixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// expirationTime returns the time of the expiration of a link, the zero time if
+// the link never expires
+func expirationTime(expiration int64) time.Time {
+	if expiration == 0 {
+		return time.Time{}
+	}
+	return time.Unix(expiration, 0)
+}
+
+// pageLinks returns the first n links sorted by token after the cursor, and the cursor
+// of the next links
+func pageLinks(links []OwnedLink, cursor string, n int) ([]OwnedLink, string) {
+	sort.Slice(links, func(i, j int) bool { return links[i].Token < links[j].Token })
+	start := sort.Search(len(links), func(i int) bool { return links[i].Token > cursor })
+	links = links[start:]
+	if len(links) <= n {
+		return links, ""
+	}
+	return links[:n], links[n-1].Token
+}
@@ -2,6 +2,7 @@ package urlhelper
 
 import (
 	"github.com/BenoitHanotte/shorturls/Godeps/_workspace/src/github.com/asaskevich/govalidator"
+	"github.com/BenoitHanotte/shorturls/metrics"
 	"net/http"
 	"time"
 	"strconv"
@@ -15,16 +16,23 @@ func IsValid(url string) bool {
 	return matched && (url[:4]=="http" || url[:5]=="https")
 }
 
+// the duration of the reachability checks, by result
+var reachabilityDuration = metrics.NewHistogramVec("shorturls_reachability_check_duration_seconds",
+	"The duration of the reachability checks of the submitted urls, by result.", metrics.DefBuckets, "reachable")
+
 // check if URL is reachable on the internet
 func IsReachable(url string, reachTimeoutMs int) bool {
+	start := time.Now()
 	client := http.Client{
 		Timeout: time.Duration(reachTimeoutMs) * time.Millisecond}
 	_, err := client.Head(url)
+	reachabilityDuration.ObserveSince(start, strconv.FormatBool(err == nil))
 	return err == nil
 }
 
+// the port is omitted when it is the default one: 80, or 443 for https
 func Build(proto string, host string, port int, ext string) string {
-	if (port==80) {
+	if (port==80 || port==443 && proto=="https") {
 		return proto+"://"+host+"/"+ext
 	} else {
 		return proto+"://"+host+":"+strconv.Itoa(port)+"/"+ext
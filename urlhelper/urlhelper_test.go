@@ -82,3 +82,16 @@ func TestIsValid(t *testing.T)  {
 	}
 }
 
+func TestBuild(t *testing.T) {
+	expected := map[string]string{
+		Build("http", "myhost.com", 80, "abc123"):   "http://myhost.com/abc123",
+		Build("https", "ex.am", 443, "abc123"):      "https://ex.am/abc123",
+		Build("http", "myhost.com", 443, "abc123"):  "http://myhost.com:443/abc123",
+		Build("http", "myhost.com", 8080, "abc123"): "http://myhost.com:8080/abc123",
+	}
+	for got, url := range expected {
+		if got != url {
+			t.Error("Wrong url: got", got, "expected", url)
+		}
+	}
+}